@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/nfs"
+)
+
+func newArchiveCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "archive",
+		Short: "Manage volumes archived on delete",
+	}
+
+	addBackendFlags(cmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the archived volumes of a backend",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			archived, err := nfs.ListArchivedVolumes(backendServer, backendShare)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tVOLUME ID\tVOLUME NAME\tSIZE\tARCHIVED AT")
+			for _, a := range archived {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", a.Name, a.VolID, a.VolName, a.VolSize, a.ArchivedAt.Local())
+			}
+			return w.Flush()
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "restore NAME",
+		Short: "Restore an archived volume as a new volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			volumeID, share, err := nfs.RestoreArchivedVolume(backendServer, backendShare, args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("volumeHandle: %s\n", volumeID)
+			fmt.Printf("volumeAttributes:\n  server: %s\n  share: %s\n", backendServer, share)
+			return nil
+		},
+	})
+
+	return cmd
+}
@@ -24,8 +24,12 @@ import (
 )
 
 var (
-	endpoint string
-	nodeID   string
+	endpoint      string
+	nodeID        string
+	backendConfig string
+	clusterID     string
+	zone          string
+	stateDir      string
 )
 
 func init() {
@@ -45,11 +49,23 @@ func main() {
 
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 
-	cmd.PersistentFlags().StringVar(&nodeID, "nodeid", "", "node id")
-	cmd.MarkPersistentFlagRequired("nodeid")
+	cmd.Flags().StringVar(&nodeID, "nodeid", "", "node id")
+	cmd.MarkFlagRequired("nodeid")
 
-	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
-	cmd.MarkPersistentFlagRequired("endpoint")
+	cmd.Flags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
+	cmd.MarkFlagRequired("endpoint")
+
+	cmd.Flags().StringVar(&backendConfig, "backend-config", "", "JSON file listing the NFS backends (server and share)")
+
+	cmd.Flags().StringVar(&clusterID, "cluster-id", "", "ID of the cluster, kept in the record of each volume")
+
+	cmd.Flags().StringVar(&zone, "zone", "", "zone of the node, reported as its topology")
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "directory of the export mounts of the node, shared with the host (default /var/lib/kubelet/plugins/csi-nfsplugin)")
+
+	cmd.AddCommand(newArchiveCommand())
+	cmd.AddCommand(newVolumeCommand())
+	cmd.AddCommand(newParametersCommand())
 
 	cmd.ParseFlags(os.Args[1:])
 	if err := cmd.Execute(); err != nil {
@@ -61,6 +77,6 @@ func main() {
 }
 
 func handle() {
-	d := nfs.NewDriver(nodeID, endpoint)
+	d := nfs.NewDriver(nodeID, endpoint, backendConfig, clusterID, zone, stateDir)
 	d.Run()
 }
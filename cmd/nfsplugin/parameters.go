@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/nfs"
+)
+
+func newParametersCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "parameters",
+		Short: "List the StorageClass parameters of the driver",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tTYPE\tDEFAULT\tALLOWED\tDESCRIPTION")
+			for _, p := range nfs.Parameters() {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.Type, p.Default, strings.Join(p.Allowed, ","), p.Description)
+			}
+			return w.Flush()
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/nfs"
+)
+
+var (
+	backendServer string
+	backendShare  string
+)
+
+// addBackendFlags adds the flags selecting the NFS backend of a command
+func addBackendFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&backendServer, "server", os.Getenv("NFS_SERVER"), "NFS server of the backend")
+	cmd.PersistentFlags().StringVar(&backendShare, "share", os.Getenv("NFS_PATH"), "NFS share of the backend")
+}
+
+func printRecord(record json.RawMessage) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, record, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+func newVolumeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "volume",
+		Short: "Show the records of provisioned volumes",
+	}
+
+	addBackendFlags(cmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Show the records of all volumes of a backend",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			records, err := nfs.ListVolumeRecords(backendServer, backendShare)
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				if err := printRecord(r); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show VOLUME_ID",
+		Short: "Show the record of a volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			record, err := nfs.GetVolumeRecord(backendServer, backendShare, args[0])
+			if err != nil {
+				return err
+			}
+			return printRecord(record)
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,170 @@
+package nfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	archivedPrefix     = "archived-"
+	archiveTimeLayout  = "20060102150405"
+	archivedRecordsDir = "archived"
+)
+
+// ArchivedVolume is a volume directory kept on the backend by DeleteVolume
+type ArchivedVolume struct {
+	Name       string    `json:"name"`
+	VolID      string    `json:"volID"`
+	VolName    string    `json:"volName"`
+	VolSize    int64     `json:"volSize"`
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+func archivedRecordPath(s *nfsServer, name string) string {
+	return filepath.Join(s.localPath(), metadataDir, archivedRecordsDir, name+".json")
+}
+
+// archiveVolume renames the volume directory to archived-<dir>-<timestamp>
+// at the backend root, where dir is the last element of the volume
+// directory, and keeps its record next to it
+func archiveVolume(s *nfsServer, nfsVol *nfsVolume) (string, error) {
+	name := fmt.Sprintf("%s%s-%s", archivedPrefix, filepath.Base(nfsVol.subDir()), time.Now().UTC().Format(archiveTimeLayout))
+	src := volumeDir(s, nfsVol)
+	dst := filepath.Join(s.localPath(), name)
+	if err := os.Rename(src, dst); err != nil {
+		return "", errors.Wrapf(err, "archive volume %s", nfsVol.VolID)
+	}
+	removeEmptyParents(s, nfsVol)
+
+	if err := writeRecord(archivedRecordPath(s, name), nfsVol); err != nil {
+		glog.Warningf("failed to save record of archived volume %s: %v", name, err)
+	}
+	// the retried delete finds the directory gone and removes the record
+	if err := removeVolume(s, nfsVol.VolID); err != nil {
+		return name, errors.Wrapf(err, "remove record of volume %s", nfsVol.VolID)
+	}
+
+	return name, nil
+}
+
+// parseArchivedName splits archived-<dir>-<timestamp> into its parts
+func parseArchivedName(name string) (string, time.Time, error) {
+	if !strings.HasPrefix(name, archivedPrefix) {
+		return "", time.Time{}, errors.Errorf("%s is not an archived volume", name)
+	}
+	i := strings.LastIndex(name, "-")
+	if i <= len(archivedPrefix) {
+		return "", time.Time{}, errors.Errorf("%s is not an archived volume", name)
+	}
+	archivedAt, err := time.Parse(archiveTimeLayout, name[i+1:])
+	if err != nil {
+		return "", time.Time{}, errors.Errorf("%s is not an archived volume", name)
+	}
+	return name[len(archivedPrefix):i], archivedAt, nil
+}
+
+// listArchivedVolumes returns the archived volumes of a backend, oldest first
+func listArchivedVolumes(s *nfsServer) ([]ArchivedVolume, error) {
+	entries, err := ioutil.ReadDir(s.localPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var archived []ArchivedVolume
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		volID, archivedAt, err := parseArchivedName(e.Name())
+		if err != nil {
+			continue
+		}
+
+		a := ArchivedVolume{Name: e.Name(), VolID: volID, ArchivedAt: archivedAt}
+		nfsVol := &nfsVolume{}
+		if err := readRecord(archivedRecordPath(s, e.Name()), nfsVol); err == nil {
+			a.VolID = nfsVol.VolID
+			a.VolName = nfsVol.VolName
+			a.VolSize = nfsVol.VolSize
+		}
+		archived = append(archived, a)
+	}
+
+	sort.Slice(archived, func(i, j int) bool {
+		return archived[i].ArchivedAt.Before(archived[j].ArchivedAt)
+	})
+	return archived, nil
+}
+
+// restoreArchivedVolume moves an archived directory back as a new volume
+func restoreArchivedVolume(s *nfsServer, name string) (*nfsVolume, error) {
+	if _, _, err := parseArchivedName(name); err != nil {
+		return nil, err
+	}
+
+	nfsVol := &nfsVolume{}
+	if err := readRecord(archivedRecordPath(s, name), nfsVol); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read record of archived volume %s", name)
+	}
+	nfsVol.Server = s.server
+	nfsVol.Share = s.path
+	nfsVol.ArchiveOnDelete = "true"
+	// the restored volume gets a new directory, the path of the archived
+	// volume may have been taken meanwhile
+	nfsVol.Path = volumeIDPrefix + uuid.NewUUID().String()
+	nfsVol.VolID = encodeVolumeID(s, nfsVol.Path)
+
+	src := filepath.Join(s.localPath(), name)
+	dst := volumeDir(s, nfsVol)
+	if err := os.Rename(src, dst); err != nil {
+		return nil, errors.Wrapf(err, "restore archived volume %s", name)
+	}
+	if err := saveVolume(s, nfsVol); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(archivedRecordPath(s, name)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove record of archived volume %s: %v", name, err)
+	}
+
+	glog.Infof("restored archived volume %s as %s", name, nfsVol.VolID)
+	return nfsVol, nil
+}
+
+// ListArchivedVolumes lists the volumes archived on an NFS backend
+func ListArchivedVolumes(server, share string) ([]ArchivedVolume, error) {
+	s := &nfsServer{server: server, path: share}
+
+	var archived []ArchivedVolume
+	err := withServer(s, func() error {
+		var err error
+		archived, err = listArchivedVolumes(s)
+		return err
+	})
+	return archived, err
+}
+
+// RestoreArchivedVolume restores an archived volume of an NFS backend as a
+// new volume and returns its volume ID and share
+func RestoreArchivedVolume(server, share, name string) (string, string, error) {
+	s := &nfsServer{server: server, path: share}
+
+	var nfsVol *nfsVolume
+	err := withServer(s, func() error {
+		var err error
+		nfsVol, err = restoreArchivedVolume(s, name)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return nfsVol.VolID, filepath.Join(s.path, nfsVol.subDir()), nil
+}
@@ -0,0 +1,114 @@
+package nfs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ValidateVolumeCapabilities confirms the capabilities if the volume exists
+// and the driver supports them, otherwise the response tells why not
+func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities cannot be empty")
+	}
+
+	s, nfsVol, err := cs.findVolume(ctx, volumeID)
+	if err == nil && s == nil {
+		// a statically provisioned volume has no record before it is
+		// published, its directory is looked for at the context location
+		s, nfsVol, err = cs.findContextVolume(ctx, volumeID, req.GetVolumeContext())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	}
+
+	if err := cs.checkVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		glog.Infof("volume %s capabilities not confirmed: %v", volumeID, err)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	// a statically provisioned volume may name its location in the context
+	volCtx := req.GetVolumeContext()
+	if server, share := volCtx["server"], volCtx["share"]; (server != "" && server != nfsVol.Server) ||
+		(share != "" && filepath.Clean(share) != filepath.Join(nfsVol.Share, nfsVol.subDir())) {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: "volume context names another location than " + nfsVol.Server + ":" + filepath.Join(nfsVol.Share, nfsVol.subDir()),
+		}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// checkVolumeCapabilities returns an error describing the first capability
+// the driver does not support, NFS volumes are only mounted
+func (cs *ControllerServer) checkVolumeCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return errors.New("volume capabilities cannot be empty")
+	}
+
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			return errors.New("block access type is not supported")
+		}
+		if c.GetMount() == nil {
+			return errors.New("access type must be mount")
+		}
+		if !cs.supportsAccessMode(c.GetAccessMode().GetMode()) {
+			return errors.Errorf("access mode %s is not supported", c.GetAccessMode().GetMode())
+		}
+		if err := checkMount(c.GetMount()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMount checks the mount flags, which are passed to mount -t nfs -o.
+// The filesystem type is ignored, NFS volumes are never formatted and the
+// sidecars set ext4 when none is given.
+func checkMount(m *csi.VolumeCapability_MountVolume) error {
+	for _, flag := range m.GetMountFlags() {
+		if flag == "" || strings.ContainsAny(flag, " \t\n") {
+			return errors.Errorf("invalid mount flag %q", flag)
+		}
+		if flag == "bind" || flag == "rbind" || strings.HasPrefix(flag, "remount") {
+			return errors.Errorf("mount flag %s is not supported", flag)
+		}
+	}
+	return nil
+}
+
+func (cs *ControllerServer) supportsAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, m := range cs.Driver.GetVolumeCapabilityAccessModes() {
+		if m.GetMode() == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// isSingleNode returns true for the access modes which allow the volume to
+// be published to one node only
+func isSingleNode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER ||
+		mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+}
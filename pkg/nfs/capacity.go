@@ -0,0 +1,168 @@
+package nfs
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/util"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetCapacity returns the free bytes of the backend selected by the
+// parameters and the topology. Backends configured with reserveProvisioned
+// report their provisioning limit, the capacity times the overcommit ratio,
+// less the size promised to provisioned volumes.
+func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		glog.Warningf("invalid get capacity req: %v", req)
+		return nil, err
+	}
+
+	for _, c := range req.GetVolumeCapabilities() {
+		if c.GetBlock() != nil {
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+
+	nfsVol, err := parseVolumeParameters(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var topology *csi.TopologyRequirement
+	if t := req.GetAccessibleTopology(); t != nil {
+		topology = &csi.TopologyRequirement{Requisite: []*csi.Topology{t}}
+	}
+	s, err := cs.selectServer(nfsVol, topology)
+	if err != nil {
+		if status.Code(err) == codes.ResourceExhausted {
+			return &csi.GetCapacityResponse{}, nil
+		}
+		return nil, err
+	}
+
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	available, capacity, err := util.FsInfo(s.localPath())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if s.reserveProvisioned {
+		provisioned, err := s.provisionedBytes()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// volumes may not have used the space promised to them yet, the
+		// limit is the one CreateVolume admits volumes with
+		available = s.provisionLimit(capacity) - provisioned
+		if available < 0 {
+			available = 0
+		}
+	}
+	glog.V(4).Infof("nfs backend %s available capacity: %d", s, available)
+
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
+
+// loadTally sums the size of the volumes recorded on the backend, the
+// backend must be mounted
+func (s *nfsServer) loadTally() error {
+	if s.tallyLoaded {
+		return nil
+	}
+
+	volumes, err := listVolumes(s)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, v := range volumes {
+		total += v.VolSize
+	}
+	s.provisioned = total
+	s.tallyLoaded = true
+	glog.Infof("nfs backend %s has %d volumes provisioning %d bytes", s, len(volumes), total)
+
+	return nil
+}
+
+// provisionedBytes returns the size promised to the volumes of the backend,
+// the backend must be mounted
+func (s *nfsServer) provisionedBytes() (int64, error) {
+	s.tallyLock.Lock()
+	defer s.tallyLock.Unlock()
+
+	if err := s.loadTally(); err != nil {
+		return 0, err
+	}
+	return s.provisioned, nil
+}
+
+// loadTallies reconstructs the tally of every registered backend, backends
+// which can not be mounted now are tallied on first use
+func (cs *ControllerServer) loadTallies() {
+	for _, s := range cs.listServers() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultMountTimeout)
+		err := cs.mounts.acquire(ctx, s)
+		cancel()
+		if err != nil {
+			glog.Warningf("failed to tally nfs backend %s: %v", s, err)
+			continue
+		}
+		if _, err := s.provisionedBytes(); err != nil {
+			glog.Warningf("failed to tally nfs backend %s: %v", s, err)
+		}
+		cs.mounts.release(s)
+	}
+}
+
+// reserveCapacity adds size to the tally of the backend. It fails with
+// ResourceExhausted if the tally would exceed the backend capacity times its
+// overcommit ratio. The backend must be mounted.
+func (cs *ControllerServer) reserveCapacity(s *nfsServer, size int64) error {
+	_, capacity, err := util.FsInfo(s.localPath())
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	s.tallyLock.Lock()
+	defer s.tallyLock.Unlock()
+
+	if err := s.loadTally(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	limit := s.provisionLimit(capacity)
+	if s.provisioned+size > limit {
+		return status.Errorf(codes.ResourceExhausted, "nfs backend %s can not provision %d bytes, %d of %d bytes are provisioned",
+			s, size, s.provisioned, limit)
+	}
+	s.provisioned += size
+
+	return nil
+}
+
+// provisionLimit returns the size the volumes of a backend with the given
+// capacity may add up to
+func (s *nfsServer) provisionLimit(capacity int64) int64 {
+	return int64(float64(capacity) * s.overcommitRatio)
+}
+
+// releaseCapacity removes size from the tally of the backend
+func (cs *ControllerServer) releaseCapacity(s *nfsServer, size int64) {
+	s.tallyLock.Lock()
+	defer s.tallyLock.Unlock()
+
+	if !s.tallyLoaded {
+		return
+	}
+	s.provisioned -= size
+	if s.provisioned < 0 {
+		s.provisioned = 0
+	}
+}
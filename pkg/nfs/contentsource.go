@@ -0,0 +1,96 @@
+package nfs
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/util"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// contentSource is the data a new volume is populated with
+type contentSource struct {
+	server *nfsServer
+	dir    string
+	size   int64
+}
+
+// getContentSource resolves the snapshot or volume a new volume is created
+// from, it returns nil if the request has no content source
+func (cs *ControllerServer) getContentSource(ctx context.Context, nfsVol *nfsVolume, src *csi.VolumeContentSource) (*contentSource, error) {
+	switch {
+	case src == nil:
+		return nil, nil
+
+	case src.GetSnapshot() != nil:
+		if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+			return nil, err
+		}
+		snapID := src.GetSnapshot().GetSnapshotId()
+		s, snap, err := cs.findSnapshot(ctx, snapID)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapID)
+		}
+		if !snap.ReadyToUse {
+			return nil, status.Errorf(codes.Unavailable, "snapshot %s is not ready to use", snapID)
+		}
+		nfsVol.SourceSnapshotID = snapID
+		return &contentSource{server: s, dir: snapshotDataPath(s, snapID), size: snap.SizeBytes}, nil
+
+	case src.GetVolume() != nil:
+		if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CLONE_VOLUME); err != nil {
+			return nil, err
+		}
+		volID := src.GetVolume().GetVolumeId()
+		s, srcVol, err := cs.findVolume(ctx, volID)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			return nil, status.Errorf(codes.NotFound, "source volume %s not found", volID)
+		}
+		nfsVol.SourceVolumeID = volID
+		return &contentSource{server: s, dir: volumeDir(s, srcVol), size: srcVol.VolSize}, nil
+	}
+
+	return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+}
+
+// copyContentSource copies the data of the content source into the volume directory
+func (cs *ControllerServer) copyContentSource(ctx context.Context, src *contentSource, dir string) error {
+	if err := cs.mounts.acquire(ctx, src.server); err != nil {
+		return err
+	}
+	defer cs.mounts.release(src.server)
+
+	size, err := util.CopyTree(src.dir, dir)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("copied %d bytes from %v to %v", size, src.dir, dir)
+
+	return nil
+}
+
+// getVolumeContentSource returns the content source recorded for a volume
+func getVolumeContentSource(nfsVol *nfsVolume) *csi.VolumeContentSource {
+	switch {
+	case nfsVol.SourceSnapshotID != "":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: nfsVol.SourceSnapshotID},
+			},
+		}
+	case nfsVol.SourceVolumeID != "":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: nfsVol.SourceVolumeID},
+			},
+		}
+	}
+	return nil
+}
@@ -1,16 +1,20 @@
 package nfs
 
 import (
-	"fmt"
+	"encoding/base64"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
-	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"github.com/zhonglin6666/kube-nfs-csi/pkg/util"
 	"golang.org/x/net/context"
@@ -22,47 +26,178 @@ const (
 	oneGB = 1073741824
 
 	mountPath = "/persistentvolumes"
+
+	volumeIDPrefix = "csi-nfs-vol-"
+
+	// parameters passed by the external-provisioner with --extra-create-metadata
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+
+	// fsTypeKey is moved into the volume capabilities and the PV by the
+	// external-provisioner, it does not reach CreateVolume as a parameter
+	fsTypeKey = "csi.storage.k8s.io/fstype"
 )
 
 type nfsServer struct {
-	server string
-	path   string
+	server             string
+	path               string
+	reserveProvisioned bool
+	overcommitRatio    float64
+	// local is where the export is reachable without an NFS mount, for a
+	// controller running on the NFS server
+	local        string
+	projectQuota bool
+	topology     map[string]string
+	// exports file managed by the controller, see syncExports
+	exportsFile   string
+	exportsReload []string
+	exportOpts    string
+
+	// tally of the size of the provisioned volumes
+	tallyLock   sync.Mutex
+	tallyLoaded bool
+	provisioned int64
 }
 
 type ControllerServer struct {
 	*csicommon.DefaultControllerServer
-	lock    *sync.RWMutex
-	nfsInfo map[string]*nfsServer
-	server  string
-	path    string
+	lock          *sync.RWMutex
+	nfsInfo       map[string]*nfsServer
+	defaultServer string
+	mounts        *serverMounter
+	clusterID     string
+	exportsLock   sync.Mutex
 }
 
 type nfsVolume struct {
-	VolName            string `json:"volName"`
-	VolID              string `json:"volID"`
-	Server             string `json:"server"`
-	Share              string `json:"share"`
-	ArchiveOnDelete    string `json:"archiveOnDelete"`
-	Provisioner        string `json:"provisioner"`
-	VolSize            int64  `json:"volSize"`
-	AdminID            string `json:"adminId"`
-	UserID             string `json:"userId"`
-	Mounter            string `json:"mounter"`
-	DisableInUseChecks bool   `json:"disableInUseChecks"`
-	ClusterID          string `json:"clusterId"`
+	VolName            string            `json:"volName"`
+	VolID              string            `json:"volID"`
+	Server             string            `json:"server"`
+	Share              string            `json:"share"`
+	ArchiveOnDelete    string            `json:"archiveOnDelete"`
+	Provisioner        string            `json:"provisioner"`
+	VolSize            int64             `json:"volSize"`
+	AdminID            string            `json:"adminId"`
+	UserID             string            `json:"userId"`
+	Mounter            string            `json:"mounter"`
+	DisableInUseChecks bool              `json:"disableInUseChecks"`
+	ClusterID          string            `json:"clusterId"`
+	Parameters         map[string]string `json:"parameters"`
+	CreationTime       time.Time         `json:"creationTime"`
+	PVCName            string            `json:"pvcName,omitempty"`
+	PVCNamespace       string            `json:"pvcNamespace,omitempty"`
+	PVName             string            `json:"pvName,omitempty"`
+	ProjectID          uint32            `json:"projectID,omitempty"`
+	SourceSnapshotID   string            `json:"sourceSnapshotID,omitempty"`
+	SourceVolumeID     string            `json:"sourceVolumeID,omitempty"`
+	// Path is the directory of the volume relative to the backend root when
+	// it is built from pathPattern
+	Path string `json:"path,omitempty"`
+	// DirMode, UID and GID are applied to the volume directory, a nil UID
+	// or GID leaves the owner the controller creates it with
+	DirMode os.FileMode `json:"dirMode"`
+	UID     *int        `json:"uid,omitempty"`
+	GID     *int        `json:"gid,omitempty"`
+	// Publications are the nodes the volume is published to
+	Publications map[string]publication `json:"publications,omitempty"`
+	// NFSVers are the NFS versions the node tries in order
+	NFSVers string `json:"nfsvers,omitempty"`
 }
 
+// ControllerExpandVolume records the new size of the volume and raises its
+// quota limit, NFS needs nothing on the node
 func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	glog.Infof("ControllerExpandVolume req: %v", req.GetVolumeId())
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		glog.Warningf("invalid expand volume req: %v", protosanitizer.StripSecrets(req))
+		return nil, err
+	}
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	capRange := req.GetCapacityRange()
+	if capRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "capacity range is nil")
+	}
+	newSize := capRange.GetRequiredBytes()
+	if newSize == 0 {
+		newSize = capRange.GetLimitBytes()
+	}
+	if capRange.GetLimitBytes() > 0 && newSize > capRange.GetLimitBytes() {
+		return nil, status.Errorf(codes.InvalidArgument, "required bytes %d exceeds limit bytes %d", newSize, capRange.GetLimitBytes())
+	}
+
+	util.VolumeNameMutex.LockKey(volumeID)
+	defer func() {
+		if err := util.VolumeNameMutex.UnlockKey(volumeID); err != nil {
+			glog.Warningf("failed to unlock mutex volume:%s %v", volumeID, err)
+		}
+	}()
+
+	s, nfsVol, err := cs.findVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	}
+	if newSize <= nfsVol.VolSize {
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: nfsVol.VolSize}, nil
+	}
+
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	if err := cs.reserveCapacity(s, newSize-nfsVol.VolSize); err != nil {
+		return nil, err
+	}
+	if nfsVol.ProjectID != 0 {
+		dir := volumeDir(s, nfsVol)
+		if err := limitProjectQuota(dir, nfsVol.ProjectID, newSize); err != nil {
+			cs.releaseCapacity(s, newSize-nfsVol.VolSize)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	oldSize := nfsVol.VolSize
+	nfsVol.VolSize = newSize
+	if err := saveVolume(s, nfsVol); err != nil {
+		cs.releaseCapacity(s, newSize-oldSize)
+		if nfsVol.ProjectID != 0 {
+			limitProjectQuota(volumeDir(s, nfsVol), nfsVol.ProjectID, oldSize)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("volume %s expanded from %d to %d bytes", volumeID, oldSize, newSize)
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         newSize,
+		NodeExpansionRequired: false,
+	}, nil
 }
 
-func NewControllerServer(csiDriver *csicommon.CSIDriver, server, path string) *ControllerServer {
-	return &ControllerServer{
+func NewControllerServer(csiDriver *csicommon.CSIDriver, servers []*nfsServer, clusterID string) (*ControllerServer, error) {
+	cs := &ControllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(csiDriver),
+		lock:                    &sync.RWMutex{},
 		nfsInfo:                 make(map[string]*nfsServer),
-		server:                  server,
-		path:                    path,
+		mounts:                  newServerMounter(),
+		clusterID:               clusterID,
+	}
+
+	for _, s := range servers {
+		if _, err := cs.registerServer(s); err != nil {
+			return nil, err
+		}
 	}
+	cs.loadTallies()
+	go cs.mounts.run()
+
+	return cs, nil
 }
 
 func (cs *ControllerServer) validateVolumeReq(req *csi.CreateVolumeRequest) error {
@@ -77,6 +212,9 @@ func (cs *ControllerServer) validateVolumeReq(req *csi.CreateVolumeRequest) erro
 	if req.VolumeCapabilities == nil {
 		return status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
+	if err := cs.checkVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
 	return nil
 }
 
@@ -98,75 +236,225 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, err
 	}
 
+	s, err := cs.selectServer(nfsVol, req.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
+	}
+	nfsVol.Server = s.server
+	nfsVol.Share = s.path
+	nfsVol.VolID = encodeVolumeID(s, nfsVol.Path)
+	nfsVol.ClusterID = cs.clusterID
+
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
 	// Check if there is already nfs with requested name
-	err = cs.checkNfsStatus(nfsVol, req, int(nfsVol.VolSize))
+	existing, err := cs.checkNfsStatus(ctx, s, nfsVol, req)
 	if err != nil {
 		return nil, err
 	}
+	if existing != nil {
+		glog.Infof("volume %s already exists as %s, backend: %v", req.GetName(), existing.VolID, s)
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           existing.VolID,
+				CapacityBytes:      existing.VolSize,
+				VolumeContext:      getVolumeContext(existing),
+				ContentSource:      getVolumeContentSource(existing),
+				AccessibleTopology: s.accessibleTopology(),
+			},
+		}, nil
+	}
 
-	//mounter := mount.New("")
-	//nfsPath := fmt.Sprintf("%v:%v", nfsVol.Server, nfsVol.Share)
-	//err = mounter.Mount(nfsPath, mountPath, "nfs", nil)
-	//if err != nil {
-	//	if os.IsPermission(err) {
-	//		return nil, status.Error(codes.PermissionDenied, err.Error())
-	//	}
-	//	if strings.Contains(err.Error(), "invalid argument") {
-	//		return nil, status.Error(codes.InvalidArgument, err.Error())
-	//	}
-	//	return nil, status.Error(codes.Internal, err.Error())
-	//}
-	//glog.Infof("mount nfs %v success", nfsPath)
-	//
-	//defer func() {
-	//	err = mount.CleanupMountPoint(mountPath, mounter, false)
-	//	if err != nil {
-	//		glog.Errorf("umount %v error: %v", mountPath, err)
-	//	} else {
-	//		glog.Infof("umount nfs: %v success", nfsPath)
-	//	}
-	//}()
-
-	fullPath := filepath.Join(mountPath, nfsVol.VolID)
-	if err := os.MkdirAll(fullPath, 0777); err != nil {
+	// the CO may refuse longer IDs, volumes created with one before are
+	// still returned above
+	if len(nfsVol.VolID) > maxVolumeIDLength {
+		return nil, status.Errorf(codes.InvalidArgument, "volume id %s is longer than %d bytes, use a shorter pathPattern or share",
+			nfsVol.VolID, maxVolumeIDLength)
+	}
+
+	src, err := cs.getContentSource(ctx, nfsVol, req.GetVolumeContentSource())
+	if err != nil {
+		return nil, err
+	}
+	if src != nil && src.size > nfsVol.VolSize {
+		return nil, status.Errorf(codes.OutOfRange, "volume size %d is smaller than the content source size %d", nfsVol.VolSize, src.size)
+	}
+
+	if err := cs.reserveCapacity(s, nfsVol.VolSize); err != nil {
+		return nil, err
+	}
+	provisioned := false
+	defer func() {
+		if !provisioned {
+			cs.releaseCapacity(s, nfsVol.VolSize)
+		}
+	}()
+
+	// A directory built from pathPattern may collide with the directory of
+	// a volume created at the same time, the check and the creation of the
+	// directories of a backend are serialized until the record is saved.
+	// The directories derived from request names can not collide.
+	derived := nfsVol.Path == legacyVolumeID(nfsVol.VolName)
+	if !derived {
+		key := s.String()
+		util.BackendPathMutex.LockKey(key)
+		defer func() {
+			if err := util.BackendPathMutex.UnlockKey(key); err != nil {
+				glog.Warningf("failed to unlock mutex backend:%s %v", key, err)
+			}
+		}()
+		if err := checkPathCollision(s, nfsVol); err != nil {
+			return nil, err
+		}
+	}
+
+	fullPath := volumeDir(s, nfsVol)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
 		return nil, errors.New("unable to create directory to provision new pv: " + err.Error())
 	}
-	if err := os.Chmod(fullPath, 0777); err != nil {
+	if err := os.Mkdir(fullPath, 0700); err != nil {
+		if !os.IsExist(err) {
+			return nil, errors.New("unable to create directory to provision new pv: " + err.Error())
+		}
+		if !derived {
+			return nil, status.Errorf(codes.AlreadyExists, "path %s of volume %s already exists", nfsVol.subDir(), nfsVol.VolName)
+		}
+		// a directory derived from the name of the request without a record
+		// was left by an earlier attempt of the request which did not
+		// finish, it starts again with an empty directory
+		if !isEmptyDir(fullPath) {
+			glog.Warningf("directory %s of unfinished volume %s is not empty, creating it again", fullPath, nfsVol.VolName)
+			if err := os.RemoveAll(fullPath); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if err := os.Mkdir(fullPath, 0700); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+	// a request failing from here on removes the directory, a retry would
+	// find it not empty and without a record
+	defer func() {
+		if provisioned {
+			return
+		}
+		if s.projectQuota {
+			if err := releaseVolumeQuota(s, nfsVol, fullPath); err != nil {
+				glog.Warningf("failed to release quota of volume %s: %v", nfsVol.VolID, err)
+			}
+			// allocated even if setting the quota failed
+			if err := releaseProjectID(s, nfsVol.VolID); err != nil {
+				glog.Warningf("failed to release project id of volume %s: %v", nfsVol.VolID, err)
+			}
+		}
+		if err := os.RemoveAll(fullPath); err != nil {
+			glog.Warningf("failed to remove directory %s of volume %s: %v", fullPath, nfsVol.VolID, err)
+			return
+		}
+		removeEmptyParents(s, nfsVol)
+	}()
+	if s.projectQuota {
+		if err := setVolumeQuota(s, cs.listServers(), nfsVol, fullPath); err != nil {
+			glog.Errorf("failed to set quota of volume %s: %v", nfsVol.VolID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if src != nil {
+		// a failed copy is removed with the directory, the retry copies
+		// again
+		if err := cs.copyContentSource(ctx, src, fullPath); err != nil {
+			glog.Errorf("failed to populate volume %s: %v", nfsVol.VolID, err)
+			return nil, err
+		}
+	}
+	// after the copy, which takes over the owner and mode of the source
+	if err := setVolumeOwnership(fullPath, nfsVol); err != nil {
+		glog.Errorf("failed to set ownership of volume %s: %v", nfsVol.VolID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	nfsVol.CreationTime = time.Now().UTC()
+	if err := saveVolume(s, nfsVol); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	provisioned = true
 	glog.Infof("create volume path: %v", fullPath)
 
-	volumeContext := req.GetParameters()
-	volumeContext["server"] = cs.server
-	volumeContext["share"] = fmt.Sprintf("%s/%s", cs.path, nfsVol.VolID)
-	//if _, ok := volumeContext["share"]; ok {
-	//	volumeContext["share"] = fmt.Sprintf("%s/%s", nfsVol.Share, nfsVol.VolID)
-	//}
-	glog.Infof("create volume success, path: %v", fullPath)
+	glog.Infof("create volume success, backend: %v path: %v", s, fullPath)
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      nfsVol.VolID,
-			CapacityBytes: nfsVol.VolSize,
-			VolumeContext: req.GetParameters(),
+			VolumeId:           nfsVol.VolID,
+			CapacityBytes:      nfsVol.VolSize,
+			VolumeContext:      getVolumeContext(nfsVol),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: s.accessibleTopology(),
 		},
 	}, nil
 }
 
+// getVolumeContext returns the parameters of a volume with the server and
+// the share the node mounts
+func getVolumeContext(nfsVol *nfsVolume) map[string]string {
+	volumeContext := volumeParametersOf(nfsVol)
+	volumeContext["server"] = nfsVol.Server
+	volumeContext["share"] = filepath.Join(nfsVol.Share, nfsVol.subDir())
+	return volumeContext
+}
+
+// hasFsType returns true if a mount capability names a filesystem type
+func hasFsType(caps []*csi.VolumeCapability) bool {
+	for _, c := range caps {
+		if c.GetMount().GetFsType() != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func parseVolCreateRequest(req *csi.CreateVolumeRequest) (*nfsVolume, error) {
-	nfsVol, err := getnfsVolumeOptions(req.GetParameters(), true)
+	nfsVol, err := parseVolumeParameters(req.GetParameters())
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	// Generating Volume Name and Volume ID, as according to CSI spec they MUST be different
+	// The volume ID names the backend and the directory, it is set once the
+	// backend is known. The directory is derived from the name so a retried
+	// request finds the volume it created.
 	nfsVol.VolName = req.GetName()
-	volumeID := "csi-nfs-vol-" + uuid.NewUUID().String()
-	nfsVol.VolID = volumeID
+	nfsVol.Path = legacyVolumeID(req.GetName())
+	nfsVol.Parameters = make(map[string]string)
+	for k, v := range req.GetParameters() {
+		nfsVol.Parameters[k] = v
+	}
+	nfsVol.Provisioner = driverName
+	nfsVol.PVCName = req.GetParameters()[pvcNameKey]
+	nfsVol.PVCNamespace = req.GetParameters()[pvcNamespaceKey]
+	nfsVol.PVName = req.GetParameters()[pvNameKey]
+	if fsGroup, _ := strconv.ParseBool(req.GetParameters()["fsGroup"]); fsGroup && !hasFsType(req.GetVolumeCapabilities()) {
+		// kubelet only changes the group of CSI volumes with an fs type
+		return nil, status.Errorf(codes.InvalidArgument, "fsGroup needs a filesystem type, set parameter %s", fsTypeKey)
+	}
+	if pattern := req.GetParameters()["pathPattern"]; pattern != "" {
+		if nfsVol.Path, err = expandPathPattern(pattern, req.GetParameters()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
 	// Volume Size - Default is 1 GiB
 	volSizeBytes := int64(oneGB)
-	if req.GetCapacityRange() != nil {
-		volSizeBytes = req.GetCapacityRange().GetRequiredBytes()
+	if capRange := req.GetCapacityRange(); capRange != nil {
+		required, limit := capRange.GetRequiredBytes(), capRange.GetLimitBytes()
+		if limit > 0 && required > limit {
+			return nil, status.Errorf(codes.InvalidArgument, "required bytes %d exceeds limit bytes %d", required, limit)
+		}
+		if required > 0 {
+			volSizeBytes = required
+		} else if limit > 0 && limit < volSizeBytes {
+			volSizeBytes = limit
+		}
 	}
 
 	nfsVol.VolSize = volSizeBytes
@@ -174,33 +462,77 @@ func parseVolCreateRequest(req *csi.CreateVolumeRequest) (*nfsVolume, error) {
 	return nfsVol, nil
 }
 
-func getnfsVolumeOptions(volOptions map[string]string, disableInUseChecks bool) (*nfsVolume, error) {
-	//var (
-	//	ok bool
-	//)
-
-	nfsVol := &nfsVolume{}
-	//nfsVol.Server, ok = volOptions["server"]
-	//if !ok {
-	//	return nil, errors.New("missing required parameter pool")
-	//}
-	//
-	//nfsVol.Share, ok = volOptions["share"]
-	//if !ok {
-	//	return nil, errors.New("missing required parameter share")
-	//}
-	//
-	//nfsVol.ArchiveOnDelete, ok = volOptions["volOptions"]
-	//if !ok {
-	//	nfsVol.ArchiveOnDelete = "false"
-	//}
+// setVolumeOwnership applies the owner and mode parameters to the volume
+// directory, the owner is changed first as chown clears the setgid bit
+func setVolumeOwnership(dir string, nfsVol *nfsVolume) error {
+	if nfsVol.UID != nil || nfsVol.GID != nil {
+		uid, gid := -1, -1
+		if nfsVol.UID != nil {
+			uid = *nfsVol.UID
+		}
+		if nfsVol.GID != nil {
+			gid = *nfsVol.GID
+		}
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return errors.Wrapf(err, "change owner of %s", dir)
+		}
+	}
+	return os.Chmod(dir, nfsVol.DirMode)
+}
 
-	return nfsVol, nil
+// checkNfsStatus looks for a volume created by an earlier request with the
+// same name. The volume is returned if it is compatible with the request,
+// AlreadyExists if it is not and nil if there is no such volume.
+func (cs *ControllerServer) checkNfsStatus(ctx context.Context, s *nfsServer, nfsVol *nfsVolume, req *csi.CreateVolumeRequest) (*nfsVolume, error) {
+	existing, err := loadVolume(s, nfsVol.VolID)
+	if os.IsNotExist(err) {
+		// created before volume IDs named their backend
+		existing, err = loadVolume(s, legacyVolumeID(nfsVol.VolName))
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// changed server or share parameters select another backend
+		other, err := cs.findNamedVolumeServer(ctx, s, nfsVol)
+		if err != nil {
+			return nil, err
+		}
+		if other != nil && other != s {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists on nfs backend %s", req.GetName(), other)
+		}
+		return nil, nil
+	}
+
+	if existing.VolName != req.GetName() {
+		return nil, status.Errorf(codes.AlreadyExists, "volume id %s is used by volume %s", existing.VolID, existing.VolName)
+	}
+	capRange := req.GetCapacityRange()
+	if existing.VolSize < capRange.GetRequiredBytes() ||
+		(capRange.GetLimitBytes() > 0 && existing.VolSize > capRange.GetLimitBytes()) {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with size %d", req.GetName(), existing.VolSize)
+	}
+	if !equalParameters(existing.Parameters, nfsVol.Parameters) {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with different parameters", req.GetName())
+	}
+	src := req.GetVolumeContentSource()
+	if existing.SourceSnapshotID != src.GetSnapshot().GetSnapshotId() || existing.SourceVolumeID != src.GetVolume().GetVolumeId() {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with a different content source", req.GetName())
+	}
+
+	return existing, nil
 }
 
-func (cs *ControllerServer) checkNfsStatus(nfsVol *nfsVolume, req *csi.CreateVolumeRequest, volSizeMiB int) error {
-	// TODO
-	return nil
+func equalParameters(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
 }
 
 // DeleteVolume deletes the volume in backend
@@ -210,60 +542,339 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		glog.Warningf("invalid delete volume req: %v", protosanitizer.StripSecrets(req))
 		return nil, err
 	}
-	// For now the image get unconditionally deleted, but here retention policy can be checked
 	volumeID := req.GetVolumeId()
-	util.VolumeNameMutex.LockKey(volumeID)
-
 	if volumeID == "" {
-		return nil, errors.New("volume id is nil")
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
 	}
 
+	// a malformed ID is rejected by findVolume, the ID of a statically
+	// provisioned volume may be any string
+	util.VolumeNameMutex.LockKey(volumeID)
 	defer func() {
 		if err := util.VolumeNameMutex.UnlockKey(volumeID); err != nil {
 			glog.Warningf("failed to unlock mutex volume:%s %v", volumeID, err)
 		}
 	}()
 
-	nfsVol := &nfsVolume{}
-	volName := nfsVol.VolName
-	fullPath := filepath.Join(mountPath, volumeID)
-
-	//mounter := mount.New("")
-	//err := mounter.Mount(fmt.Sprintf("%v:%v", nfsVol.Server, nfsVol.Share), mountPath, "nfs", nil)
-	//if err != nil {
-	//	if os.IsPermission(err) {
-	//		return nil, status.Error(codes.PermissionDenied, err.Error())
-	//	}
-	//	if strings.Contains(err.Error(), "invalid argument") {
-	//		return nil, status.Error(codes.InvalidArgument, err.Error())
-	//	}
-	//	return nil, status.Error(codes.Internal, err.Error())
-	//}
-	//
-	//defer func() {
-	//	err = mount.CleanupMountPoint(mountPath, mounter, false)
-	//	if err != nil {
-	//		glog.Errorf("umount %v error: %v", mountPath, err)
-	//	}
-	//}()
-
-	glog.Infof("deleting volume %s path: %v", volName, fullPath)
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		glog.Warningf("path %s does not exist, deletion skipped", fullPath)
-		return nil, nil
+	s, nfsVol, err := cs.findVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		glog.Warningf("volume %s not found on any nfs backend, deletion skipped", volumeID)
+		return &csi.DeleteVolumeResponse{}, nil
 	}
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	fullPath := volumeDir(s, nfsVol)
 
-	if err := os.RemoveAll(fullPath); err != nil {
-		glog.Error("nfs volume can not remove path: %v", fullPath)
+	glog.Infof("deleting volume %s path: %v", nfsVol.VolName, fullPath)
+	if err := releaseVolumeQuota(s, nfsVol, fullPath); err != nil {
+		glog.Errorf("failed to release quota of volume %s: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the directory is gone when an earlier request failed after removing
+	// or archiving it, the record is removed all the same
+	_, err = os.Stat(fullPath)
+	switch archive, _ := strconv.ParseBool(nfsVol.ArchiveOnDelete); {
+	case os.IsNotExist(err):
+		glog.Warningf("path %s does not exist, only the record of volume %s is removed", fullPath, volumeID)
+		if err := removeVolume(s, volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	case nfsVol.Path == ".":
+		// a statically provisioned volume of a whole backend keeps its data
+		glog.Warningf("volume %s is the root of nfs backend %s, only its record is removed", volumeID, s)
+		if err := removeVolume(s, volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case archive:
+		name, err := archiveVolume(s, nfsVol)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("volume %s archived as %v", volumeID, name)
+	default:
+		if err := os.RemoveAll(fullPath); err != nil {
+			glog.Errorf("nfs volume can not remove path: %v", fullPath)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		removeEmptyParents(s, nfsVol)
+		// a record left behind is removed by the retry
+		if err := removeVolume(s, volumeID); err != nil {
+			glog.Errorf("failed to remove record of volume %s: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	// released once the record is gone, so a retry does not release the
+	// size again
+	cs.releaseCapacity(s, nfsVol.VolSize)
+	if len(nfsVol.Publications) > 0 {
+		if err := cs.syncExports(ctx, s); err != nil {
+			glog.Warningf("failed to remove exports of volume %s: %v", volumeID, err)
+		}
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return &csi.ControllerPublishVolumeResponse{}, nil
+// findVolumeServer returns the backend holding the volume record or, for
+// volumes without a record, the volume directory, or nil if no registered
+// backend has it. With recordOnly the directory is not looked for, the ID
+// is no directory name.
+func (cs *ControllerServer) findVolumeServer(ctx context.Context, volumeID string, recordOnly bool) (*nfsServer, error) {
+	for _, s := range cs.listServers() {
+		if err := cs.mounts.acquire(ctx, s); err != nil {
+			glog.Warningf("skip nfs backend %s when looking up volume %s: %v", s, volumeID, err)
+			continue
+		}
+		_, err := os.Stat(volumeRecordPath(s, volumeID))
+		if os.IsNotExist(err) && !recordOnly {
+			_, err = os.Stat(filepath.Join(s.localPath(), volumeID))
+		}
+		cs.mounts.release(s)
+		if err == nil {
+			return s, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return nil, nil
 }
 
-func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return &csi.ControllerUnpublishVolumeResponse{}, nil
+// findNamedVolumeServer returns a backend other than s holding a volume
+// created for the same request name, or nil if there is none
+func (cs *ControllerServer) findNamedVolumeServer(ctx context.Context, s *nfsServer, nfsVol *nfsVolume) (*nfsServer, error) {
+	legacyID := legacyVolumeID(nfsVol.VolName)
+	for _, other := range cs.listServers() {
+		if other == s {
+			continue
+		}
+		if err := cs.mounts.acquire(ctx, other); err != nil {
+			glog.Warningf("skip nfs backend %s when looking up volume %s: %v", other, nfsVol.VolName, err)
+			continue
+		}
+		var found bool
+		for _, path := range []string{
+			volumeRecordPath(other, encodeVolumeID(other, nfsVol.Path)),
+			volumeRecordPath(other, legacyID),
+			filepath.Join(other.localPath(), legacyID),
+		} {
+			if _, err := os.Stat(path); err == nil {
+				found = true
+				break
+			}
+		}
+		cs.mounts.release(other)
+		if found {
+			return other, nil
+		}
+	}
+	return nil, nil
+}
+
+// findVolume returns the backend and the record of a volume, the backend is
+// nil if the volume does not exist. Volumes without a record are the ones
+// provisioned before records were kept or statically provisioned ones.
+func (cs *ControllerServer) findVolume(ctx context.Context, volumeID string) (*nfsServer, *nfsVolume, error) {
+	loc, err := parseVolumeID(volumeID)
+	// the ID of a statically provisioned volume may be any string, such a
+	// volume is only found by the record kept when it is published
+	static := err != nil && !strings.Contains(volumeID, volumeIDSep)
+	if err != nil && !static {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var s *nfsServer
+	if loc == nil {
+		if s, err = cs.findVolumeServer(ctx, volumeID, static); err != nil || s == nil {
+			return nil, nil, err
+		}
+	} else if s, err = cs.getServer(loc.server, loc.share); err != nil {
+		return nil, nil, err
+	}
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, nil, err
+	}
+	defer cs.mounts.release(s)
+
+	nfsVol, err := loadVolume(s, volumeID)
+	if err == nil {
+		return s, nfsVol, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+
+	nfsVol = newLegacyVolume(s, volumeID)
+	if loc != nil {
+		nfsVol.Path = loc.subDir
+		if _, err := os.Stat(volumeDir(s, nfsVol)); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil, nil
+			}
+			return nil, nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return s, nfsVol, nil
+}
+
+// findContextVolume locates a statically provisioned volume the driver has
+// no record of by the server and share of its volume context. The share is
+// a directory of the registered backend of the server holding it, or is
+// registered as a backend of its own. The backend is nil if the directory
+// does not exist.
+func (cs *ControllerServer) findContextVolume(ctx context.Context, volumeID string, volCtx map[string]string) (*nfsServer, *nfsVolume, error) {
+	server, share := volCtx["server"], filepath.Clean(volCtx["share"])
+	if server == "" || volCtx["share"] == "" {
+		return nil, nil, nil
+	}
+
+	var s *nfsServer
+	for _, b := range cs.listServers() {
+		if b.server == server && isSubPath(share, b.path) && (s == nil || len(b.path) > len(s.path)) {
+			s = b
+		}
+	}
+	// the backend root is the directory "."
+	subDir := "."
+	if s != nil {
+		if rel, _ := filepath.Rel(s.path, share); rel != "." {
+			if err := validateSubDir(rel); err != nil {
+				return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			subDir = rel
+		}
+	} else {
+		var err error
+		if s, err = cs.getServer(server, share); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, nil, err
+	}
+	defer cs.mounts.release(s)
+
+	nfsVol := newLegacyVolume(s, volumeID)
+	nfsVol.Path = subDir
+	if _, err := os.Stat(volumeDir(s, nfsVol)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	return s, nfsVol, nil
+}
+
+// ListVolumes returns the volumes of all registered backends, ordered by
+// backend and volume ID so that a continuation token stays valid while
+// volumes are created and deleted
+func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		glog.Warningf("invalid list volumes req: %v", req)
+		return nil, err
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+
+	var start string
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		if start, err = decodeListToken(token); err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+
+	resp := &csi.ListVolumesResponse{}
+	for _, s := range cs.listServers() {
+		volumes, err := cs.listServerVolumes(ctx, s)
+		if err != nil {
+			glog.Warningf("skip nfs backend %s when listing volumes: %v", s, err)
+			continue
+		}
+
+		for _, nfsVol := range volumes {
+			key := listKey(s, nfsVol.VolID)
+			if key < start {
+				continue
+			}
+			if req.GetMaxEntries() > 0 && len(resp.Entries) == int(req.GetMaxEntries()) {
+				resp.NextToken = encodeListToken(key)
+				return resp, nil
+			}
+			resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+				Volume: &csi.Volume{
+					VolumeId:           nfsVol.VolID,
+					CapacityBytes:      nfsVol.VolSize,
+					VolumeContext:      getVolumeContext(nfsVol),
+					AccessibleTopology: s.accessibleTopology(),
+				},
+			})
+		}
+	}
+
+	return resp, nil
+}
+
+// listServerVolumes returns the volumes of a backend sorted by ID, volumes
+// provisioned before records were kept are included
+func (cs *ControllerServer) listServerVolumes(ctx context.Context, s *nfsServer) ([]*nfsVolume, error) {
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	volumes, err := listVolumes(s)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := make(map[string]bool, len(volumes))
+	for _, v := range volumes {
+		recorded[v.subDir()] = true
+	}
+	entries, err := ioutil.ReadDir(s.localPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), volumeIDPrefix) && !recorded[e.Name()] {
+			volumes = append(volumes, newLegacyVolume(s, e.Name()))
+		}
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolID < volumes[j].VolID
+	})
+	return volumes, nil
+}
+
+// listKey orders volumes by backend first, the separator sorts before any
+// character of a share path
+func listKey(s *nfsServer, volID string) string {
+	return s.String() + "\x00" + volID
+}
+
+func encodeListToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeListToken(token string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(string(key), "\x00") {
+		return "", errors.New("malformed token")
+	}
+	return string(key), nil
 }
@@ -26,10 +26,14 @@ import (
 )
 
 type driver struct {
-	csiDriver *csicommon.CSIDriver
-	endpoint  string
-
-	ids   *csicommon.DefaultIdentityServer
+	csiDriver     *csicommon.CSIDriver
+	endpoint      string
+	backendConfig string
+	clusterID     string
+	zone          string
+	stateDir      string
+
+	ids   *identityServer
 	ns    *nodeServer
 	cs    *ControllerServer
 	cap   []*csi.VolumeCapability_AccessMode
@@ -44,15 +48,26 @@ var (
 	version = "1.0.0"
 )
 
-func NewDriver(nodeID, endpoint string) *driver {
+func NewDriver(nodeID, endpoint, backendConfig, clusterID, zone, stateDir string) *driver {
 	glog.Infof("Driver: %v version: %v", driverName, version)
 
 	d := &driver{}
 
 	d.endpoint = endpoint
+	d.backendConfig = backendConfig
+	d.clusterID = clusterID
+	d.zone = zone
+	d.stateDir = stateDir
+	if d.stateDir == "" {
+		d.stateDir = defaultStateDir
+	}
 
 	csiDriver := csicommon.NewCSIDriver(driverName, version, nodeID)
 	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
 		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 	})
 
@@ -60,6 +75,11 @@ func NewDriver(nodeID, endpoint string) *driver {
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 	})
 
 	d.csiDriver = csiDriver
@@ -68,34 +88,50 @@ func NewDriver(nodeID, endpoint string) *driver {
 }
 
 func NewNodeServer(d *driver, server, path string) (*nodeServer, error) {
-	return &nodeServer{
+	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		mounter:           newCtxMounter(),
+		exports:           newExportMounter(d.stateDir),
 		server:            server,
 		path:              path,
-	}, nil
+		zone:              d.zone,
+	}
+	go ns.exports.run()
+
+	return ns, nil
 }
 
 func (d *driver) Run() {
 	var err error
 	s := csicommon.NewNonBlockingGRPCServer()
 
+	// NFS_SERVER and NFS_PATH register the default backend, more backends
+	// can be listed in the backend config file
 	server := os.Getenv("NFS_SERVER")
-	//if server == "" {
-	//	glog.Fatal("NFS_SERVER not set")
-	//}
-
 	path := os.Getenv("NFS_PATH")
-	//if path == "" {
-	//	glog.Fatal("NFS_PATH not set")
-	//}
+
+	var servers []*nfsServer
+	if server != "" || path != "" {
+		servers = append(servers, &nfsServer{server: server, path: path})
+	}
+	if d.backendConfig != "" {
+		configured, err := loadServerConfig(d.backendConfig)
+		if err != nil {
+			glog.Fatalf("failed to load backend config, err %v", err)
+		}
+		servers = append(servers, configured...)
+	}
 
 	d.ns, err = NewNodeServer(d, server, path)
 	if err != nil {
-		glog.Fatal("failed to start node server, err %v\n", err)
+		glog.Fatalf("failed to start node server, err %v", err)
 	}
 
-	d.ids = csicommon.NewDefaultIdentityServer(d.csiDriver)
-	d.cs = NewControllerServer(d.csiDriver, server, path)
+	d.ids = NewIdentityServer(d)
+	d.cs, err = NewControllerServer(d.csiDriver, servers, d.clusterID)
+	if err != nil {
+		glog.Fatalf("failed to start controller server, err %v", err)
+	}
 
 	s.Start(d.endpoint, d.ids, d.cs, d.ns)
 	s.Wait()
@@ -0,0 +1,128 @@
+package nfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/exec"
+)
+
+const (
+	defaultExportOptions = "rw,sync,no_subtree_check"
+	exportsHeader        = "# generated by " + driverName + ", do not edit\n"
+)
+
+var defaultExportsReloadCommand = []string{"exportfs", "-ra"}
+
+// validateExportClient checks that a node ID can be used as the client of
+// an export, an IP address or a host name
+func validateExportClient(nodeID string) error {
+	if net.ParseIP(nodeID) != nil {
+		return nil
+	}
+	if msgs := validation.IsDNS1123Subdomain(strings.ToLower(nodeID)); len(msgs) > 0 {
+		return errors.Errorf("node id %q is neither an IP address nor a host name: %s", nodeID, strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// exportOptions returns the export options of a publication, a readonly
+// publication gets ro instead of rw
+func (s *nfsServer) exportOptions(readonly bool) string {
+	if !readonly {
+		return s.exportOpts
+	}
+
+	opts := []string{"ro"}
+	for _, o := range strings.Split(s.exportOpts, ",") {
+		if o != "rw" && o != "ro" {
+			opts = append(opts, o)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// exportLine returns the line of the exports file granting the nodes a
+// volume is published to access to its directory
+func exportLine(s *nfsServer, nfsVol *nfsVolume) string {
+	nodes := make([]string, 0, len(nfsVol.Publications))
+	for node := range nfsVol.Publications {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%q", filepath.Join(s.path, nfsVol.subDir()))
+	for _, node := range nodes {
+		fmt.Fprintf(&b, " %s(%s)", node, s.exportOptions(nfsVol.Publications[node].Readonly))
+	}
+	return b.String()
+}
+
+// syncExports renders the exports file of a backend from the publications
+// of the volumes of all backends sharing the file and runs the reload
+// command of the backend
+func (cs *ControllerServer) syncExports(ctx context.Context, s *nfsServer) error {
+	if s.exportsFile == "" {
+		return nil
+	}
+
+	cs.exportsLock.Lock()
+	defer cs.exportsLock.Unlock()
+
+	var lines []string
+	for _, backend := range cs.listServers() {
+		if backend.exportsFile != s.exportsFile {
+			continue
+		}
+		if err := cs.mounts.acquire(ctx, backend); err != nil {
+			return err
+		}
+		volumes, err := listVolumes(backend)
+		cs.mounts.release(backend)
+		if err != nil {
+			return errors.Wrapf(err, "list volumes of nfs backend %s", backend)
+		}
+
+		for _, v := range volumes {
+			if len(v.Publications) > 0 {
+				lines = append(lines, exportLine(backend, v))
+			}
+		}
+	}
+	sort.Strings(lines)
+
+	content := exportsHeader + strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := writeExports(s.exportsFile, content); err != nil {
+		return errors.Wrapf(err, "write exports file %s", s.exportsFile)
+	}
+
+	out, err := exec.New().Command(s.exportsReload[0], s.exportsReload[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("reload exports with %s failed: %v, output: %s", strings.Join(s.exportsReload, " "), err, string(out))
+	}
+	glog.V(4).Infof("exports file %s reloaded with %d exports", s.exportsFile, len(lines))
+	return nil
+}
+
+// writeExports replaces the exports file atomically
+func writeExports(file, content string) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
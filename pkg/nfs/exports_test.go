@@ -0,0 +1,155 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestValidateExportClient(t *testing.T) {
+	tests := []struct {
+		nodeID string
+		err    bool
+	}{
+		{"192.168.73.10", false},
+		{"fd00::10", false},
+		{"node-1.example.com", false},
+		{"Node-1", false},
+		{"node_1", true},
+		{"*", true},
+		{"node-1(rw)", true},
+	}
+
+	for _, test := range tests {
+		err := validateExportClient(test.nodeID)
+		if test.err && err == nil {
+			t.Errorf("%s: want an error", test.nodeID)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%s: %v", test.nodeID, err)
+		}
+	}
+}
+
+func TestExportLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		volume  *nfsVolume
+		want    string
+	}{
+		{
+			name:    "nodes are sorted",
+			options: defaultExportOptions,
+			volume: &nfsVolume{VolID: "vol-a", Publications: map[string]publication{
+				"node-b": {AccessMode: "MULTI_NODE_MULTI_WRITER"},
+				"node-a": {AccessMode: "MULTI_NODE_MULTI_WRITER"},
+			}},
+			want: `"/export/vol-a" node-a(rw,sync,no_subtree_check) node-b(rw,sync,no_subtree_check)`,
+		},
+		{
+			name:    "readonly publication",
+			options: defaultExportOptions,
+			volume: &nfsVolume{VolID: "vol-a", Publications: map[string]publication{
+				"node-a": {AccessMode: "MULTI_NODE_READER_ONLY", Readonly: true},
+				"node-b": {AccessMode: "MULTI_NODE_MULTI_WRITER"},
+			}},
+			want: `"/export/vol-a" node-a(ro,sync,no_subtree_check) node-b(rw,sync,no_subtree_check)`,
+		},
+		{
+			name:    "readonly publication with options without rw",
+			options: "async,no_root_squash",
+			volume: &nfsVolume{VolID: "vol-a", Publications: map[string]publication{
+				"node-a": {AccessMode: "SINGLE_NODE_READER_ONLY", Readonly: true},
+			}},
+			want: `"/export/vol-a" node-a(ro,async,no_root_squash)`,
+		},
+		{
+			name:    "directory of a pathPattern",
+			options: defaultExportOptions,
+			volume: &nfsVolume{VolID: "v1#127.0.0.1#/export#team a/data", Path: "team a/data", Publications: map[string]publication{
+				"192.168.73.10": {AccessMode: "SINGLE_NODE_WRITER"},
+			}},
+			want: `"/export/team a/data" 192.168.73.10(rw,sync,no_subtree_check)`,
+		},
+	}
+
+	for _, test := range tests {
+		s := &nfsServer{server: "127.0.0.1", path: "/export", exportOpts: test.options}
+		if got := exportLine(s, test.volume); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSyncExports(t *testing.T) {
+	a, cleanupA := newTestServer(t)
+	defer cleanupA()
+	b, cleanupB := newTestServer(t)
+	defer cleanupB()
+	other, cleanupOther := newTestServer(t)
+	defer cleanupOther()
+
+	exportsFile := filepath.Join(a.local, "csi-nfsplugin.exports")
+	b.path = "/export/b"
+	other.path = "/export/other"
+	for _, s := range []*nfsServer{a, b} {
+		s.exportsFile = exportsFile
+		s.exportsReload = []string{"true"}
+		s.exportOpts = defaultExportOptions
+	}
+	other.exportsFile = filepath.Join(other.local, "other.exports")
+	other.exportsReload = []string{"true"}
+	other.exportOpts = defaultExportOptions
+
+	cs := &ControllerServer{
+		lock:    &sync.RWMutex{},
+		nfsInfo: map[string]*nfsServer{a.String(): a, b.String(): b, other.String(): other},
+		mounts:  newServerMounter(),
+	}
+
+	volumes := []struct {
+		s      *nfsServer
+		volume *nfsVolume
+	}{
+		{a, &nfsVolume{VolID: "vol-a", Publications: map[string]publication{"node-1": {AccessMode: "SINGLE_NODE_WRITER"}}}},
+		// a volume which is not published is not exported
+		{a, &nfsVolume{VolID: "vol-b"}},
+		{b, &nfsVolume{VolID: "vol-c", Publications: map[string]publication{"node-2": {AccessMode: "MULTI_NODE_READER_ONLY", Readonly: true}}}},
+		// a backend with another exports file is left out
+		{other, &nfsVolume{VolID: "vol-d", Publications: map[string]publication{"node-3": {AccessMode: "SINGLE_NODE_WRITER"}}}},
+	}
+	for _, v := range volumes {
+		if err := saveVolume(v.s, v.volume); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cs.syncExports(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(exportsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := exportsHeader +
+		`"/export/b/vol-c" node-2(ro,sync,no_subtree_check)` + "\n" +
+		`"/export/vol-a" node-1(rw,sync,no_subtree_check)` + "\n"
+	if string(data) != want {
+		t.Errorf("got exports file\n%s\nwant\n%s", data, want)
+	}
+
+	// a backend without an exports file has nothing to sync
+	a.exportsFile = ""
+	if err := cs.syncExports(context.Background(), a); err != nil {
+		t.Errorf("sync without exports file: %v", err)
+	}
+
+	other.exportsReload = []string{"false"}
+	if err := cs.syncExports(context.Background(), other); err == nil {
+		t.Errorf("sync with a failing reload command: want an error")
+	}
+}
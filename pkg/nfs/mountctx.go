@@ -0,0 +1,214 @@
+package nfs
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// defaultMountTimeout bounds the mounts and unmounts of requests
+	// without a deadline and of the health check
+	defaultMountTimeout = 2 * time.Minute
+)
+
+// mountContext returns ctx with defaultMountTimeout unless it has a
+// deadline already
+func mountContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, defaultMountTimeout)
+}
+
+// ctxMounter runs mount and umount so that they are killed when the context
+// is done, the other calls go to the embedded mounter
+type ctxMounter struct {
+	mount.Interface
+}
+
+func newCtxMounter() *ctxMounter {
+	return &ctxMounter{Interface: mount.New("")}
+}
+
+// runContext runs a command in its own process group and kills the group
+// when the context is done, mount.nfs is a child of mount and would keep
+// hanging on an unreachable server otherwise
+func runContext(ctx context.Context, name string, args ...string) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "%s %s", name, strings.Join(args, " "))
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, out.String())
+		}
+		return nil
+	case <-ctx.Done():
+		// the process may be stuck in the kernel until the kill is
+		// delivered, it is reaped by the goroutine waiting for it
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			glog.Warningf("kill %s %s error: %v", name, strings.Join(args, " "), err)
+		}
+		return errors.Wrapf(ctx.Err(), "%s %s", name, strings.Join(args, " "))
+	}
+}
+
+// MountContext mounts source at target, a bind mount with more options is
+// remounted with them as mount ignores them for the bind. The bind is
+// unmounted if the remount fails, so a readonly target is never left
+// writable.
+func (m *ctxMounter) MountContext(ctx context.Context, source, target, fstype string, options []string) error {
+	var rest []string
+	bind := false
+	for _, o := range options {
+		if o == "bind" {
+			bind = true
+		} else {
+			rest = append(rest, o)
+		}
+	}
+	if bind && len(rest) > 0 {
+		if err := runContext(ctx, "mount", mountArgs(source, target, fstype, []string{"bind"})...); err != nil {
+			return err
+		}
+		err := runContext(ctx, "mount", mountArgs(source, target, fstype, append([]string{"bind", "remount"}, rest...))...)
+		if err != nil {
+			if uerr := m.UnmountContext(ctx, target); uerr != nil {
+				glog.Errorf("umount bind mount %v after failed remount error: %v", target, uerr)
+			}
+		}
+		return err
+	}
+	return runContext(ctx, "mount", mountArgs(source, target, fstype, options)...)
+}
+
+func mountArgs(source, target, fstype string, options []string) []string {
+	var args []string
+	if fstype != "" {
+		args = append(args, "-t", fstype)
+	}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	return append(args, source, target)
+}
+
+// UnmountContext unmounts target, forcibly or lazily if umount does not
+// finish before the context is done
+func (m *ctxMounter) UnmountContext(ctx context.Context, target string) error {
+	err := runContext(ctx, "umount", target)
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	glog.Warningf("umount %v timed out, err %v, umount it forcibly", target, err)
+	return forceUnmount(target)
+}
+
+// IsLikelyNotMountPointContext is IsLikelyNotMountPoint bounded by the
+// context, the stat of a mount whose server does not answer hangs. The
+// stat is left behind when the context is done.
+func (m *ctxMounter) IsLikelyNotMountPointContext(ctx context.Context, path string) (bool, error) {
+	type result struct {
+		notMnt bool
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		notMnt, err := m.IsLikelyNotMountPoint(path)
+		done <- result{notMnt, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.notMnt, r.err
+	case <-ctx.Done():
+		return false, errors.Wrapf(ctx.Err(), "check mount point %s", path)
+	}
+}
+
+// statContext is os.Stat bounded by the context, like
+// IsLikelyNotMountPointContext
+func statContext(ctx context.Context, path string) (os.FileInfo, error) {
+	type result struct {
+		info os.FileInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := os.Stat(path)
+		done <- result{info, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.info, r.err
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "stat %s", path)
+	}
+}
+
+// CleanupMountPointContext unmounts path if it is mounted and removes it,
+// like mount.CleanupMountPoint with the checks and the unmount bounded by
+// the context. A path which cannot be checked in time is unmounted
+// forcibly.
+func (m *ctxMounter) CleanupMountPointContext(ctx context.Context, path string) error {
+	notMnt, err := m.IsLikelyNotMountPointContext(ctx, path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case ctx.Err() != nil:
+		glog.Warningf("check of mount point %v timed out, umount it forcibly", path)
+		if err := forceUnmount(path); err != nil {
+			return err
+		}
+		return removeMountPoint(path)
+	case err != nil && !mount.IsCorruptedMnt(err):
+		return errors.Wrapf(err, "check path %s", path)
+	case err == nil && notMnt:
+		return removeMountPoint(path)
+	}
+
+	if err := m.UnmountContext(ctx, path); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		// unmounted forcibly or lazily, the path is no mount point anymore
+		return removeMountPoint(path)
+	}
+	notMnt, err = m.IsLikelyNotMountPointContext(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !notMnt {
+		return errors.Errorf("failed to unmount path %s", path)
+	}
+	return removeMountPoint(path)
+}
+
+func removeMountPoint(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package nfs
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// nfsVersKey is the volume context key of the NFS versions the node
+	// tries in order
+	nfsVersKey = "nfsvers"
+)
+
+// nfsVersions are the NFS versions a volume can ask for
+var nfsVersions = []string{"4.2", "4.1", "4.0", "4", "3"}
+
+// parseNFSVersions parses a comma separated list of NFS versions in the
+// order they are tried
+func parseNFSVersions(list string) ([]string, error) {
+	var versions []string
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if !containsString(nfsVersions, v) {
+			return nil, errors.Errorf("nfs version %q is not supported, supported versions are %s", v, strings.Join(nfsVersions, ", "))
+		}
+		if containsString(versions, v) {
+			return nil, errors.Errorf("nfs version %s is listed twice", v)
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// hasVersionFlag returns true if the mount flags set the NFS version
+func hasVersionFlag(options []string) bool {
+	for _, o := range options {
+		if strings.HasPrefix(o, "vers=") || strings.HasPrefix(o, "nfsvers=") || strings.HasPrefix(o, "minorversion=") {
+			return true
+		}
+	}
+	return false
+}
+
+// isProtocolError returns true if a mount failed because the server or the
+// kernel does not support the NFS version, the next version is tried then
+func isProtocolError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{
+		"protocol not supported",
+		"requested nfs version or transport protocol is not supported",
+		"program not registered",
+		"an incorrect mount option was specified",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountedVersion returns the NFS version a path is mounted with, "" if it
+// is not found in the mount table. The last mount of the path wins.
+func mountedVersion(mounter mount.Interface, path string) string {
+	mps, err := mounter.List()
+	if err != nil {
+		return ""
+	}
+	var version string
+	for _, mp := range mps {
+		if mp.Path != path {
+			continue
+		}
+		for _, o := range mp.Opts {
+			if strings.HasPrefix(o, "vers=") {
+				version = strings.TrimPrefix(o, "vers=")
+			}
+		}
+	}
+	return version
+}
@@ -0,0 +1,284 @@
+package nfs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/keymutex"
+)
+
+const (
+	// defaultStateDir is where the node keeps its export mounts and their
+	// users, it must be shared with the host
+	defaultStateDir = "/var/lib/kubelet/plugins/" + driverName
+)
+
+// exportMount is an NFS export mounted once on the node and shared by the
+// volumes staged from it
+type exportMount struct {
+	Server  string   `json:"server"`
+	Share   string   `json:"share"`
+	Options []string `json:"options"`
+	// Versions are the NFS versions tried in order, Version is the one the
+	// export is mounted with
+	Versions []string `json:"versions,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Path     string   `json:"path"`
+	// Volumes are the volumes staged from the export by volume ID
+	Volumes map[string]*stagedVolume `json:"volumes"`
+}
+
+// stagedVolume is where a volume is bind mounted from its export, the
+// health check remounts these paths when the export goes stale
+type stagedVolume struct {
+	StagingPath string `json:"stagingPath,omitempty"`
+	SubDir      string `json:"subDir,omitempty"`
+	// Targets maps the target paths of the volume to their readonly flag
+	Targets map[string]bool `json:"targets,omitempty"`
+}
+
+func (e *exportMount) source() string {
+	return fmt.Sprintf("%s:%s", e.Server, e.Share)
+}
+
+// exportMounter mounts each export with the same options once per node and
+// counts the volumes staged from it in a state file, so the counts survive
+// restarts of the node plugin
+type exportMounter struct {
+	stateDir string
+	mounter  *ctxMounter
+	// stateLock guards the state file
+	stateLock sync.Mutex
+	// serializes mount and unmount of the same export
+	keyMutex keymutex.KeyMutex
+}
+
+func newExportMounter(stateDir string) *exportMounter {
+	return &exportMounter{
+		stateDir: stateDir,
+		mounter:  newCtxMounter(),
+		keyMutex: keymutex.NewHashed(0),
+	}
+}
+
+// exportKey identifies the mount of an export with a set of options and
+// NFS versions
+func exportKey(server, share string, options, versions []string) string {
+	sorted := append([]string(nil), options...)
+	sort.Strings(sorted)
+	sum := sha1.Sum([]byte(serverKey(server, share) + "|" + strings.Join(sorted, ",") + "|" + strings.Join(versions, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *exportMounter) statePath() string {
+	return filepath.Join(m.stateDir, "exports.json")
+}
+
+// update runs fn on the export mounts of the state file and saves them
+func (m *exportMounter) update(fn func(exports map[string]*exportMount)) error {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	exports := make(map[string]*exportMount)
+	if err := readRecord(m.statePath(), &exports); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fn(exports)
+	return writeRecord(m.statePath(), exports)
+}
+
+// list returns the export mounts of the state file
+func (m *exportMounter) list() (map[string]*exportMount, error) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	exports := make(map[string]*exportMount)
+	if err := readRecord(m.statePath(), &exports); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return exports, nil
+}
+
+// acquire mounts the export unless it is mounted already and adds the
+// volume to its users. Without versions the export is mounted with the
+// version mount.nfs picks.
+func (m *exportMounter) acquire(ctx context.Context, volumeID, server, share string, options, versions []string) (*exportMount, error) {
+	key := exportKey(server, share, options, versions)
+	m.keyMutex.LockKey(key)
+	defer m.keyMutex.UnlockKey(key)
+
+	e := &exportMount{
+		Server:   server,
+		Share:    share,
+		Options:  options,
+		Versions: versions,
+		Path:     filepath.Join(m.stateDir, "exports", key),
+	}
+	notMnt, err := m.mounter.IsLikelyNotMountPointContext(ctx, e.Path)
+	if isStale(err) {
+		glog.Warningf("nfs export %v at %v is stale, err %v", e.source(), e.Path, err)
+		if err := m.repairLocked(ctx, key); err != nil {
+			return nil, err
+		}
+		notMnt, err = m.mounter.IsLikelyNotMountPointContext(ctx, e.Path)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, mountError(err)
+		}
+		if err := os.MkdirAll(e.Path, 0750); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		notMnt = true
+	}
+	if notMnt {
+		if err := m.mountExport(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+
+	err = m.update(func(exports map[string]*exportMount) {
+		if existing, ok := exports[key]; ok {
+			e.Volumes = existing.Volumes
+			if !notMnt {
+				e.Version = existing.Version
+			}
+		}
+		if e.Volumes == nil {
+			e.Volumes = make(map[string]*stagedVolume)
+		}
+		if _, ok := e.Volumes[volumeID]; !ok {
+			e.Volumes[volumeID] = &stagedVolume{}
+		}
+		exports[key] = e
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return e, nil
+}
+
+// mountExport mounts the export with the first of its versions the server
+// supports, falling back to the next version on protocol errors, and
+// records the version it is mounted with
+func (m *exportMounter) mountExport(ctx context.Context, e *exportMount) error {
+	if len(e.Versions) == 0 {
+		if err := m.mounter.MountContext(ctx, e.source(), e.Path, "nfs", e.Options); err != nil {
+			return mountError(err)
+		}
+		e.Version = mountedVersion(m.mounter, e.Path)
+		glog.Infof("mount nfs export %v at %v with nfs version %v success", e.source(), e.Path, e.Version)
+		return nil
+	}
+
+	var err error
+	for _, v := range e.Versions {
+		options := append(append([]string(nil), e.Options...), "vers="+v)
+		err = m.mounter.MountContext(ctx, e.source(), e.Path, "nfs", options)
+		if err == nil {
+			e.Version = v
+			if mounted := mountedVersion(m.mounter, e.Path); mounted != "" {
+				e.Version = mounted
+			}
+			glog.Infof("mount nfs export %v at %v with nfs version %v success", e.source(), e.Path, e.Version)
+			return nil
+		}
+		if !isProtocolError(err) {
+			return mountError(err)
+		}
+		glog.Warningf("nfs version %v of %v is not supported, err %v", v, e.source(), err)
+	}
+	return status.Errorf(codes.InvalidArgument, "none of nfs versions %s is supported by %s, last err %v",
+		strings.Join(e.Versions, ","), e.source(), err)
+}
+
+// volumeExport returns the export mount a volume is staged from, nil if the
+// volume is not staged
+func (m *exportMounter) volumeExport(volumeID string) (*exportMount, error) {
+	exports, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range exports {
+		if _, ok := e.Volumes[volumeID]; ok {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// setVolume runs fn on the staged volume and saves it, nothing is done if
+// the volume is not staged
+func (m *exportMounter) setVolume(volumeID string, fn func(v *stagedVolume)) error {
+	return m.update(func(exports map[string]*exportMount) {
+		for _, e := range exports {
+			if v, ok := e.Volumes[volumeID]; ok {
+				fn(v)
+			}
+		}
+	})
+}
+
+// release removes the volume from the users of its export and unmounts the
+// export after its last user
+func (m *exportMounter) release(ctx context.Context, volumeID string) error {
+	staged, err := m.volumeExport(volumeID)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if staged == nil {
+		return nil
+	}
+	key := filepath.Base(staged.Path)
+
+	m.keyMutex.LockKey(key)
+	defer m.keyMutex.UnlockKey(key)
+
+	exports, err := m.list()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	e, ok := exports[key]
+	if !ok {
+		return nil
+	}
+	// the export is unmounted before it is dropped from the state file, a
+	// failed unmount is retried with the next unstage
+	if _, ok := e.Volumes[volumeID]; ok && len(e.Volumes) == 1 {
+		if _, err := statContext(ctx, e.Path); isStale(err) {
+			if err := forceUnmount(e.Path); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			glog.Infof("repair stale nfs export %v at %v: unmounted", e.source(), e.Path)
+		}
+		if err := m.mounter.CleanupMountPointContext(ctx, e.Path); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("umount nfs export %v at %v success", e.source(), e.Path)
+	}
+
+	err = m.update(func(exports map[string]*exportMount) {
+		e, ok := exports[key]
+		if !ok {
+			return
+		}
+		delete(e.Volumes, volumeID)
+		if len(e.Volumes) == 0 {
+			delete(exports, key)
+		}
+	})
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
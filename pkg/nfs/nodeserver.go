@@ -17,13 +17,13 @@ limitations under the License.
 package nfs
 
 import (
-	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/util"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -32,15 +32,65 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
-	mounter mount.Interface
+	mounter *ctxMounter
+	// exports mounts the exports staged volumes are bind mounted from
+	exports *exportMounter
 	server  string
 	path    string
+	// zone is reported as the topology of the node
+	zone string
+}
+
+// NodeGetInfo reports the zone of the node, volumes of backends in other
+// zones are not scheduled to it
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if ns.zone != "" {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: map[string]string{topologyZoneKey: ns.zone},
+		}
+	}
+	return resp, nil
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	glog.Infof("zzlin NodePublishVolume begin...")
+	glog.Infof("NodePublishVolume req: %v", req.GetVolumeId())
+	// mount and umount are killed at the deadline of the request
+	ctx, cancel := mountContext(ctx)
+	defer cancel()
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is nil")
+	}
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is nil")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is nil")
+	}
+
+	// a stale staging path or target is remounted with the export of the
+	// volume, the target is mounted again if it was recorded
+	if _, err := statContext(ctx, req.GetStagingTargetPath()); isStale(err) {
+		glog.Warningf("staging path %v of volume %v is stale, err %v", req.GetStagingTargetPath(), req.GetVolumeId(), err)
+		if err := ns.exports.repairVolume(ctx, req.GetVolumeId(), req.GetStagingTargetPath()); err != nil {
+			return nil, err
+		}
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPointContext(ctx, targetPath)
+	if isStale(err) {
+		glog.Warningf("target %v of volume %v is stale, err %v", targetPath, req.GetVolumeId(), err)
+		if err := ns.exports.repairVolume(ctx, req.GetVolumeId(), targetPath); err != nil {
+			return nil, err
+		}
+		notMnt, err = ns.mounter.IsLikelyNotMountPointContext(ctx, targetPath)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(targetPath, 0750); err != nil {
@@ -48,72 +98,353 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			}
 			notMnt = true
 		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, mountError(err)
 		}
 	}
 
 	if !notMnt {
+		if err := ns.checkPublished(ctx, req.GetStagingTargetPath(), targetPath, req.GetReadonly()); err != nil {
+			return nil, err
+		}
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	mo := req.GetVolumeCapability().GetMount().GetMountFlags()
+	// a lost staging mount would give the pod a directory on the disk of
+	// the node
+	stagingNotMnt, err := ns.mounter.IsLikelyNotMountPointContext(ctx, req.GetStagingTargetPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, mountError(err)
+	}
+	if err != nil || stagingNotMnt {
+		return nil, status.Errorf(codes.FailedPrecondition, "staging path %s of volume %s is not mounted", req.GetStagingTargetPath(), req.GetVolumeId())
+	}
+
+	// the staging path is already the volume directory, the pod gets a bind
+	// mount of it
+	mo := []string{"bind"}
 	if req.GetReadonly() {
 		mo = append(mo, "ro")
 	}
+	glog.Infof("publish volume %v target: %v staging path: %v", req.GetVolumeId(), targetPath, req.GetStagingTargetPath())
 
-	s := req.GetVolumeContext()["server"]
-	ep := req.GetVolumeContext()["share"]
-	source := fmt.Sprintf("%s:%s", s, ep)
-	glog.Info("zzlin publish volume target: %v  server: %v", source)
-
-	mounter := mount.New("")
-	err = mounter.Mount(source, targetPath, "nfs", mo)
-	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
-		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+	if err := ns.mounter.MountContext(ctx, req.GetStagingTargetPath(), targetPath, "", mo); err != nil {
+		return nil, mountError(err)
+	}
+	err = ns.exports.setVolume(req.GetVolumeId(), func(v *stagedVolume) {
+		if v.Targets == nil {
+			v.Targets = make(map[string]bool)
 		}
+		v.Targets[targetPath] = req.GetReadonly()
+	})
+	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// checkPublished returns AlreadyExists unless the target is a mount of the
+// staging path with the readonly flag of the request
+func (ns *nodeServer) checkPublished(ctx context.Context, stagingPath, targetPath string, readonly bool) error {
+	staging, err := statContext(ctx, stagingPath)
+	if err != nil {
+		return mountError(err)
+	}
+	target, err := statContext(ctx, targetPath)
+	if err != nil {
+		return mountError(err)
+	}
+	// a bind mount of the staging path is the same directory
+	if !os.SameFile(staging, target) {
+		return status.Errorf(codes.AlreadyExists, "target %s is mounted from another source than %s", targetPath, stagingPath)
+	}
+
+	mps, err := ns.mounter.List()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	// a target mounted from a readonly staging path is readonly for every
+	// request
+	if ro := mountedReadonly(mps, targetPath); ro != (readonly || mountedReadonly(mps, stagingPath)) {
+		return status.Errorf(codes.AlreadyExists, "target %s is mounted with readonly %v, requested %v", targetPath, ro, readonly)
+	}
+	return nil
+}
+
+// mountedReadonly returns true if the last mount of path is readonly
+func mountedReadonly(mps []mount.MountPoint, path string) bool {
+	var readonly bool
+	for _, mp := range mps {
+		if mp.Path == path {
+			readonly = containsString(mp.Opts, "ro")
+		}
+	}
+	return readonly
+}
+
+// NodeUnpublishVolume unmounts and removes the target, a target which is
+// not mounted or does not exist is unpublished already
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	glog.Infof("zzlin NodeUnpublishVolume begin...")
+	glog.Infof("NodeUnpublishVolume req: %v", req.GetVolumeId())
+	ctx, cancel := mountContext(ctx)
+	defer cancel()
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is nil")
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPointContext(ctx, targetPath)
+	if isStale(err) {
+		// the target goes away, it only has to be unmounted
+		glog.Warningf("target %v of volume %v is stale, err %v", targetPath, req.GetVolumeId(), err)
+		if err := forceUnmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("repair stale target %v of volume %v: unmounted", targetPath, req.GetVolumeId())
+		notMnt, err = ns.mounter.IsLikelyNotMountPointContext(ctx, targetPath)
+	}
+	switch {
+	case os.IsNotExist(err):
+		glog.V(4).Infof("target %v of volume %v does not exist", targetPath, req.GetVolumeId())
+	case ctx.Err() != nil:
+		// the server of the target does not answer, it is unmounted
+		// without knowing if it is mounted
+		glog.Warningf("check of target %v of volume %v timed out, umount it forcibly", targetPath, req.GetVolumeId())
+		if err := forceUnmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	case notMnt:
+		// left by an unpublish which did not finish or a publish which failed
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("target %v of volume %v is not mounted", targetPath, req.GetVolumeId())
+	default:
+		if err := ns.mounter.CleanupMountPointContext(ctx, targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	err = ns.exports.setVolume(req.GetVolumeId(), func(v *stagedVolume) {
+		delete(v.Targets, targetPath)
+	})
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, status.Error(codes.NotFound, "Targetpath not found")
-		} else {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeStageVolume mounts the export of the volume unless the node has it
+// mounted already and bind mounts the volume directory at the staging path
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	glog.Infof("NodeStageVolume req: %v", req.GetVolumeId())
+	ctx, cancel := mountContext(ctx)
+	defer cancel()
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is nil")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is nil")
+	}
+	if req.GetVolumeCapability().GetMount() == nil {
+		return nil, status.Error(codes.InvalidArgument, "only the mount access type is supported")
+	}
+
+	server, export, subDir, err := volumeSource(volumeID, req.GetVolumeContext(), req.GetPublishContext())
+	if err != nil {
+		return nil, err
+	}
+
+	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+	var versions []string
+	if list := req.GetVolumeContext()[nfsVersKey]; list != "" {
+		if versions, err = parseNFSVersions(list); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if hasVersionFlag(mountFlags) {
+			return nil, status.Errorf(codes.InvalidArgument, "mount flags set the nfs version, %s must not be set", nfsVersKey)
+		}
+	}
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPointContext(ctx, stagingPath)
+	if isStale(err) {
+		glog.Warningf("staging path %v of volume %v is stale, err %v", stagingPath, volumeID, err)
+		if err := ns.exports.repairVolume(ctx, volumeID, stagingPath); err != nil {
+			return nil, err
+		}
+		notMnt, err = ns.mounter.IsLikelyNotMountPointContext(ctx, stagingPath)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, mountError(err)
+		}
+		if err := os.MkdirAll(stagingPath, 0750); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+		notMnt = true
 	}
-	if notMnt {
-		return nil, status.Error(codes.NotFound, "Volume not mounted")
+	if !notMnt {
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	err = mount.CleanupMountPoint(req.GetTargetPath(), mount.New(""), false)
+	e, err := ns.exports.acquire(ctx, volumeID, server, export, mountFlags, versions)
+	if err != nil {
+		return nil, err
+	}
+	source := filepath.Join(e.Path, subDir)
+	if _, err := statContext(ctx, source); err != nil {
+		ns.exports.release(ctx, volumeID)
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume directory %s not found on %s:%s", subDir, server, export)
+		}
+		return nil, mountError(err)
+	}
+	if err := ns.mounter.MountContext(ctx, source, stagingPath, "", []string{"bind"}); err != nil {
+		ns.exports.release(ctx, volumeID)
+		return nil, mountError(err)
+	}
+	err = ns.exports.setVolume(volumeID, func(v *stagedVolume) {
+		v.StagingPath = stagingPath
+		v.SubDir = subDir
+	})
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	glog.Infof("stage volume %v from %v at %v with nfs version %v success", volumeID, source, stagingPath, e.Version)
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// NodeUnstageVolume unmounts the staging path and the export of the volume
+// after its last volume
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	glog.Infof("zzlin NodeUnstageVolume begin...")
+	glog.Infof("NodeUnstageVolume req: %v", req.GetVolumeId())
+	ctx, cancel := mountContext(ctx)
+	defer cancel()
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is nil")
+	}
+
+	if _, err := statContext(ctx, req.GetStagingTargetPath()); isStale(err) {
+		if err := forceUnmount(req.GetStagingTargetPath()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("repair stale staging path %v of volume %v: unmounted", req.GetStagingTargetPath(), req.GetVolumeId())
+	}
+	if err := ns.mounter.CleanupMountPointContext(ctx, req.GetStagingTargetPath()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.exports.release(ctx, req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	glog.Infof("zzlin NodeStageVolume begin...")
-	return &csi.NodeStageVolumeResponse{}, nil
+// NodeGetCapabilities reports that volumes are staged and have stats
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	var caps []*csi.NodeServiceCapability
+	for _, c := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	} {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: c},
+			},
+		})
+	}
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
+// NodeGetVolumeStats reports the space and inodes of the filesystem of the
+// export a volume is staged from and logs the NFS version of the export
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is nil")
+	}
+
+	stats, err := util.FsStats(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s not found", volumePath)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if e, err := ns.exports.volumeExport(req.GetVolumeId()); err == nil && e != nil {
+		glog.V(4).Infof("volume %v is staged from %v with nfs version %v", req.GetVolumeId(), e.source(), e.Version)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Available: stats.Available,
+				Total:     stats.Capacity,
+				Used:      stats.Capacity - stats.Free,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Available: stats.InodesFree,
+				Total:     stats.Inodes,
+				Used:      stats.Inodes - stats.InodesFree,
+			},
+		},
+	}, nil
+}
+
+// volumeSource returns the server and export a volume is staged from and
+// the directory of the volume below the export. Volumes with a v1 ID share
+// the mount of the backend root, other volumes mount their share.
+func volumeSource(volumeID string, volCtx, pubCtx map[string]string) (server, export, subDir string, err error) {
+	// a backend with an exports file exports each volume directory on its
+	// own, the controller names the export on publish
+	if pubCtx["server"] != "" && pubCtx["share"] != "" {
+		return pubCtx["server"], pubCtx["share"], "", nil
+	}
+	s, share := volCtx["server"], volCtx["share"]
+	// the ID of a static volume may be anything, it is only used when it
+	// parses
+	loc, _ := parseVolumeID(volumeID)
+	if loc != nil && (s == "" && share == "" || s == loc.server && share == filepath.Join(loc.share, loc.subDir)) {
+		return loc.server, loc.share, loc.subDir, nil
+	}
+	if s == "" || share == "" {
+		return "", "", "", status.Error(codes.InvalidArgument, "volume context has no server and share")
+	}
+	return s, share, "", nil
+}
+
+// NodeExpandVolume has nothing to do, the size of an NFS volume is only
+// enforced on the server
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is nil")
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+	}, nil
 }
@@ -0,0 +1,288 @@
+package nfs
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// parameters with this prefix are set by the external-provisioner and
+	// not part of the schema
+	csiParameterPrefix = "csi.storage.k8s.io/"
+)
+
+// paramType is the type of the value of a StorageClass parameter
+type paramType string
+
+const (
+	paramString paramType = "string"
+	paramBool   paramType = "bool"
+	paramUint   paramType = "uint"
+	paramOctal  paramType = "octal"
+)
+
+// parameter describes a StorageClass parameter and how it is stored in a
+// volume. set gets the value converted to the type of the parameter, get
+// returns the value of a volume, "" if it is not set.
+type parameter struct {
+	name        string
+	typ         paramType
+	def         string
+	allowed     []string
+	description string
+	set         func(v *nfsVolume, value interface{}) error
+	get         func(v *nfsVolume) string
+}
+
+// volumeParameters are the StorageClass parameters of the driver, they are
+// applied in this order
+var volumeParameters = []parameter{
+	{
+		name:        "server",
+		typ:         paramString,
+		description: "NFS server of the backend, set together with share, the default backend is used without them",
+		set:         func(v *nfsVolume, value interface{}) error { v.Server = value.(string); return nil },
+		get:         func(v *nfsVolume) string { return v.Server },
+	},
+	{
+		name:        "share",
+		typ:         paramString,
+		description: "NFS share of the backend, set together with server",
+		set:         func(v *nfsVolume, value interface{}) error { v.Share = value.(string); return nil },
+		get:         func(v *nfsVolume) string { return v.Share },
+	},
+	{
+		name:        "archiveOnDelete",
+		typ:         paramBool,
+		def:         "false",
+		description: "keep the volume directory as archived-<directory>-<timestamp> when the volume is deleted",
+		set: func(v *nfsVolume, value interface{}) error {
+			v.ArchiveOnDelete = strconv.FormatBool(value.(bool))
+			return nil
+		},
+		get: func(v *nfsVolume) string { return v.ArchiveOnDelete },
+	},
+	{
+		name:        "pathPattern",
+		typ:         paramString,
+		description: "directory of the volume built from ${namespace}, ${pvcName} and ${pvName}",
+		set: func(v *nfsVolume, value interface{}) error {
+			// expanded by CreateVolume, the PVC and PV names are not
+			// known to the other calls
+			return checkPathPatternVars(value.(string))
+		},
+	},
+	{
+		name:        "directoryMode",
+		typ:         paramOctal,
+		def:         "0770",
+		description: "octal mode of the volume directory, setuid is not allowed",
+		set: func(v *nfsVolume, value interface{}) error {
+			m := value.(uint64)
+			if m > 03777 {
+				return errors.Errorf("mode %o is not allowed", m)
+			}
+			v.DirMode = os.FileMode(m) & os.ModePerm
+			if m&02000 != 0 {
+				v.DirMode |= os.ModeSetgid
+			}
+			if m&01000 != 0 {
+				v.DirMode |= os.ModeSticky
+			}
+			return nil
+		},
+		get: func(v *nfsVolume) string {
+			if v.DirMode == 0 {
+				return ""
+			}
+			m := uint64(v.DirMode & os.ModePerm)
+			if v.DirMode&os.ModeSetgid != 0 {
+				m |= 02000
+			}
+			if v.DirMode&os.ModeSticky != 0 {
+				m |= 01000
+			}
+			return "0" + strconv.FormatUint(m, 8)
+		},
+	},
+	{
+		name:        "uid",
+		typ:         paramUint,
+		description: "owner of the volume directory",
+		set:         func(v *nfsVolume, value interface{}) error { v.UID = intPtr(value.(uint64)); return nil },
+		get:         func(v *nfsVolume) string { return formatIntPtr(v.UID) },
+	},
+	{
+		name:        "gid",
+		typ:         paramUint,
+		description: "group of the volume directory",
+		set:         func(v *nfsVolume, value interface{}) error { v.GID = intPtr(value.(uint64)); return nil },
+		get:         func(v *nfsVolume) string { return formatIntPtr(v.GID) },
+	},
+	{
+		name:        "fsGroup",
+		typ:         paramBool,
+		def:         "false",
+		description: "make the volume directory group writable with the setgid bit for the fsGroup of pods, needs " + fsTypeKey + " set to nfs",
+		set: func(v *nfsVolume, value interface{}) error {
+			if value.(bool) {
+				// files created in the volume inherit the fsGroup kubelet sets
+				v.DirMode |= os.ModeSetgid | 0070
+			}
+			return nil
+		},
+	},
+	{
+		name:        nfsVersKey,
+		typ:         paramString,
+		description: "comma separated NFS versions the node tries in order, e.g. 4.2,4.1,3, the version mount.nfs picks when not set",
+		set: func(v *nfsVolume, value interface{}) error {
+			versions, err := parseNFSVersions(value.(string))
+			if err != nil {
+				return err
+			}
+			v.NFSVers = strings.Join(versions, ",")
+			return nil
+		},
+		get: func(v *nfsVolume) string { return v.NFSVers },
+	},
+}
+
+// parseValue converts the value of a parameter to its type
+func (p *parameter) parseValue(value string) (interface{}, error) {
+	if len(p.allowed) > 0 && !containsString(p.allowed, value) {
+		return nil, errors.Errorf("invalid %s %q, allowed values are %s", p.name, value, strings.Join(p.allowed, ", "))
+	}
+
+	switch p.typ {
+	case paramBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.Errorf("invalid %s %q, want a bool", p.name, value)
+		}
+		return b, nil
+	case paramUint:
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return nil, errors.Errorf("invalid %s %q, want a non negative integer", p.name, value)
+		}
+		return n, nil
+	case paramOctal:
+		n, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid %s %q, want an octal number", p.name, value)
+		}
+		return n, nil
+	}
+	return value, nil
+}
+
+// parseVolumeParameters validates the StorageClass parameters against the
+// schema and returns a volume with the parameters and their defaults
+// applied. Parameters set by the external-provisioner are skipped, other
+// unknown parameters are rejected.
+func parseVolumeParameters(params map[string]string) (*nfsVolume, error) {
+	known := make(map[string]bool, len(volumeParameters))
+	for _, p := range volumeParameters {
+		known[p.name] = true
+	}
+	var unknown []string
+	for k := range params {
+		if !known[k] && !strings.HasPrefix(k, csiParameterPrefix) {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.Errorf("unknown parameters %s", strings.Join(unknown, ", "))
+	}
+
+	nfsVol := &nfsVolume{}
+	for i := range volumeParameters {
+		p := &volumeParameters[i]
+		value, ok := params[p.name]
+		if !ok {
+			if p.def == "" {
+				continue
+			}
+			value = p.def
+		}
+		v, err := p.parseValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.set(nfsVol, v); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s %q", p.name, value)
+		}
+	}
+
+	// server and share are optional, the default backend is used without them
+	if (nfsVol.Server == "") != (nfsVol.Share == "") {
+		return nil, errors.New("parameters server and share must be set together")
+	}
+
+	return nfsVol, nil
+}
+
+// volumeParametersOf returns the parameters of the schema a volume has
+func volumeParametersOf(nfsVol *nfsVolume) map[string]string {
+	params := make(map[string]string)
+	for _, p := range volumeParameters {
+		if p.get == nil {
+			continue
+		}
+		if v := p.get(nfsVol); v != "" {
+			params[p.name] = v
+		}
+	}
+	return params
+}
+
+// ParameterInfo describes a StorageClass parameter of the driver
+type ParameterInfo struct {
+	Name        string
+	Type        string
+	Default     string
+	Allowed     []string
+	Description string
+}
+
+// Parameters returns the StorageClass parameters of the driver
+func Parameters() []ParameterInfo {
+	infos := make([]ParameterInfo, 0, len(volumeParameters))
+	for _, p := range volumeParameters {
+		infos = append(infos, ParameterInfo{
+			Name:        p.name,
+			Type:        string(p.typ),
+			Default:     p.def,
+			Allowed:     p.allowed,
+			Description: p.description,
+		})
+	}
+	return infos
+}
+
+func intPtr(n uint64) *int {
+	i := int(n)
+	return &i
+}
+
+func formatIntPtr(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
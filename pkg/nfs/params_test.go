@@ -0,0 +1,196 @@
+package nfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseVolumeParameters(t *testing.T) {
+	uid := 1000
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   *nfsVolume
+		err    bool
+	}{
+		{
+			name: "defaults",
+			want: &nfsVolume{ArchiveOnDelete: "false", DirMode: 0770},
+		},
+		{
+			name:   "external-provisioner parameters are skipped",
+			params: map[string]string{"csi.storage.k8s.io/pvc/name": "data", fsTypeKey: "nfs"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: 0770},
+		},
+		{
+			name:   "unknown parameter",
+			params: map[string]string{"mode": "0755"},
+			err:    true,
+		},
+		{
+			name:   "unknown parameter with a csi prefix of another domain",
+			params: map[string]string{"csi.example.com/fstype": "nfs"},
+			err:    true,
+		},
+		{
+			name:   "backend",
+			params: map[string]string{"server": "192.168.73.184", "share": "/nfs/data"},
+			want:   &nfsVolume{Server: "192.168.73.184", Share: "/nfs/data", ArchiveOnDelete: "false", DirMode: 0770},
+		},
+		{
+			name:   "server without share",
+			params: map[string]string{"server": "192.168.73.184"},
+			err:    true,
+		},
+		{
+			name:   "share without server",
+			params: map[string]string{"share": "/nfs/data"},
+			err:    true,
+		},
+		{
+			name:   "archiveOnDelete",
+			params: map[string]string{"archiveOnDelete": "true"},
+			want:   &nfsVolume{ArchiveOnDelete: "true", DirMode: 0770},
+		},
+		{
+			name:   "invalid archiveOnDelete",
+			params: map[string]string{"archiveOnDelete": "yes"},
+			err:    true,
+		},
+		{
+			name:   "directoryMode",
+			params: map[string]string{"directoryMode": "0755"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: 0755},
+		},
+		{
+			name:   "directoryMode without leading zero",
+			params: map[string]string{"directoryMode": "700"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: 0700},
+		},
+		{
+			name:   "directoryMode with setgid and sticky bits",
+			params: map[string]string{"directoryMode": "03770"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: os.ModeSetgid | os.ModeSticky | 0770},
+		},
+		{
+			name:   "directoryMode with setuid bit",
+			params: map[string]string{"directoryMode": "04770"},
+			err:    true,
+		},
+		{
+			name:   "directoryMode not octal",
+			params: map[string]string{"directoryMode": "0778"},
+			err:    true,
+		},
+		{
+			name:   "uid",
+			params: map[string]string{"uid": "1000"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: 0770, UID: &uid},
+		},
+		{
+			name:   "negative gid",
+			params: map[string]string{"gid": "-1"},
+			err:    true,
+		},
+		{
+			name:   "gid not a number",
+			params: map[string]string{"gid": "users"},
+			err:    true,
+		},
+		{
+			name:   "uid out of range",
+			params: map[string]string{"uid": "4294967296"},
+			err:    true,
+		},
+		{
+			name:   "fsGroup",
+			params: map[string]string{"fsGroup": "true", "directoryMode": "0700"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: os.ModeSetgid | 0770},
+		},
+		{
+			name:   "fsGroup false",
+			params: map[string]string{"fsGroup": "false"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: 0770},
+		},
+		{
+			name:   "nfsvers",
+			params: map[string]string{nfsVersKey: "4.1, 3"},
+			want:   &nfsVolume{ArchiveOnDelete: "false", DirMode: 0770, NFSVers: "4.1,3"},
+		},
+		{
+			name:   "unsupported nfsvers",
+			params: map[string]string{nfsVersKey: "2"},
+			err:    true,
+		},
+		{
+			name:   "nfsvers listed twice",
+			params: map[string]string{nfsVersKey: "3,3"},
+			err:    true,
+		},
+		{
+			name:   "pathPattern with an unknown variable",
+			params: map[string]string{"pathPattern": "${namespace}/${storageClass}"},
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseVolumeParameters(test.params)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got volume %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got volume %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestVolumeParametersOf(t *testing.T) {
+	tests := []map[string]string{
+		{},
+		{
+			"server":          "192.168.73.184",
+			"share":           "/nfs/data",
+			"archiveOnDelete": "true",
+			"directoryMode":   "02750",
+			"uid":             "1000",
+			"gid":             "0",
+			nfsVersKey:        "4.2,3",
+		},
+		{"directoryMode": "01777"},
+	}
+
+	for _, params := range tests {
+		nfsVol, err := parseVolumeParameters(params)
+		if err != nil {
+			t.Errorf("parse %v: %v", params, err)
+			continue
+		}
+		got := volumeParametersOf(nfsVol)
+		// the defaults are part of the volume
+		want := map[string]string{"archiveOnDelete": "false", "directoryMode": "0770"}
+		for k, v := range params {
+			want[k] = v
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parameters of volume %+v: got %v, want %v", nfsVol, got, want)
+		}
+
+		again, err := parseVolumeParameters(got)
+		if err != nil {
+			t.Errorf("parse %v again: %v", got, err)
+			continue
+		}
+		if !reflect.DeepEqual(again, nfsVol) {
+			t.Errorf("parse %v again: got volume %+v, want %+v", got, again, nfsVol)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package nfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pathPatternVars maps the variables of the pathPattern parameter to the
+// parameters passed by the external-provisioner
+var pathPatternVars = map[string]string{
+	"namespace": pvcNamespaceKey,
+	"pvcName":   pvcNameKey,
+	"pvName":    pvNameKey,
+}
+
+// checkPathPatternVars checks that a pattern only uses known variables
+func checkPathPatternVars(pattern string) error {
+	var err error
+	os.Expand(pattern, func(name string) string {
+		if _, ok := pathPatternVars[name]; !ok && err == nil {
+			err = errors.Errorf("unknown variable ${%s}", name)
+		}
+		return name
+	})
+	return err
+}
+
+// expandPathPattern builds the subdirectory of a volume from a pattern like
+// ${namespace}/${pvcName}, the result must be a relative path inside the
+// backend which does not clash with the directories of the driver
+func expandPathPattern(pattern string, params map[string]string) (string, error) {
+	var expandErr error
+	path := os.Expand(pattern, func(name string) string {
+		key, ok := pathPatternVars[name]
+		if !ok {
+			if expandErr == nil {
+				expandErr = errors.Errorf("unknown variable ${%s} in pathPattern", name)
+			}
+			return ""
+		}
+		value := params[key]
+		if value == "" && expandErr == nil {
+			expandErr = errors.Errorf("pathPattern variable ${%s} needs parameter %s, run the external-provisioner with --extra-create-metadata", name, key)
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	if err := validateSubDir(path); err != nil {
+		return "", errors.Wrapf(err, "pathPattern %q", pattern)
+	}
+	if strings.HasPrefix(path, archivedPrefix) || strings.HasPrefix(path, volumeIDPrefix) {
+		return "", errors.Errorf("pathPattern %q gives path %q reserved for the driver", pattern, path)
+	}
+
+	return path, nil
+}
+
+// isSubPath returns true if path equals base or lies below it
+func isSubPath(path, base string) bool {
+	return path == base || strings.HasPrefix(path, base+string(filepath.Separator))
+}
+
+// checkPathCollision makes sure the subdirectory of a new volume is not used
+// by another volume and neither contains nor is contained in one
+func checkPathCollision(s *nfsServer, nfsVol *nfsVolume) error {
+	volumes, err := listVolumes(s)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	path := nfsVol.subDir()
+	for _, v := range volumes {
+		if v.VolID == nfsVol.VolID {
+			continue
+		}
+		if isSubPath(path, v.subDir()) || isSubPath(v.subDir(), path) {
+			return status.Errorf(codes.AlreadyExists, "path %s of volume %s collides with volume %s at %s",
+				path, nfsVol.VolName, v.VolName, v.subDir())
+		}
+	}
+	return nil
+}
+
+// isEmptyDir returns true if dir is a directory without entries
+func isEmptyDir(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(1)
+	return err == io.EOF && len(names) == 0
+}
+
+// removeEmptyParents removes the parents of a volume directory left empty
+// by its deletion, up to the root of the backend
+func removeEmptyParents(s *nfsServer, nfsVol *nfsVolume) {
+	for dir := filepath.Dir(nfsVol.subDir()); dir != "."; dir = filepath.Dir(dir) {
+		if err := os.Remove(filepath.Join(s.localPath(), dir)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package nfs
+
+import "testing"
+
+func TestExpandPathPattern(t *testing.T) {
+	params := map[string]string{
+		pvcNamespaceKey: "default",
+		pvcNameKey:      "data-web-0",
+		pvNameKey:       "pvc-0a2b",
+	}
+	tests := []struct {
+		name    string
+		pattern string
+		params  map[string]string
+		want    string
+		err     bool
+	}{
+		{
+			name:    "namespace and pvc name",
+			pattern: "${namespace}/${pvcName}",
+			params:  params,
+			want:    "default/data-web-0",
+		},
+		{
+			name:    "fixed text",
+			pattern: "k8s/${namespace}-${pvName}",
+			params:  params,
+			want:    "k8s/default-pvc-0a2b",
+		},
+		{
+			name:    "unknown variable",
+			pattern: "${namespace}/${storageClass}",
+			params:  params,
+			err:     true,
+		},
+		{
+			name:    "missing metadata",
+			pattern: "${namespace}/${pvcName}",
+			params:  map[string]string{pvNameKey: "pvc-0a2b"},
+			err:     true,
+		},
+		{
+			name:    "absolute path",
+			pattern: "/${namespace}",
+			params:  params,
+			err:     true,
+		},
+		{
+			name:    "parent element",
+			pattern: "../${pvName}",
+			params:  params,
+			err:     true,
+		},
+		{
+			name:    "parent element from a value",
+			pattern: "${namespace}/${pvcName}",
+			params:  map[string]string{pvcNamespaceKey: "..", pvcNameKey: "etc"},
+			err:     true,
+		},
+		{
+			name:    "hidden element",
+			pattern: ".${namespace}/${pvcName}",
+			params:  params,
+			err:     true,
+		},
+		{
+			name:    "unclean path",
+			pattern: "${namespace}//${pvcName}",
+			params:  params,
+			err:     true,
+		},
+		{
+			name:    "separator of volume ids",
+			pattern: "${namespace}#${pvcName}",
+			params:  params,
+			err:     true,
+		},
+		{
+			name:    "archived directory",
+			pattern: "archived-${pvName}",
+			params:  params,
+			err:     true,
+		},
+		{
+			name:    "default volume directory",
+			pattern: "csi-nfs-vol-${pvName}",
+			params:  params,
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := expandPathPattern(test.pattern, test.params)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got path %q, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got path %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package nfs
+
+import (
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/util"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// publication is a node a volume is published to
+type publication struct {
+	AccessMode string `json:"accessMode"`
+	Readonly   bool   `json:"readonly"`
+}
+
+func (p publication) mode() csi.VolumeCapability_AccessMode_Mode {
+	return csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[p.AccessMode])
+}
+
+// ControllerPublishVolume records the node a volume is published to and
+// grants it access to the volume on backends with an exports file. A single
+// node volume is refused on a second node and a multi node single writer
+// volume on a second writer.
+func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	glog.Infof("ControllerPublishVolume req: %v node: %v", req.GetVolumeId(), req.GetNodeId())
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	nodeID := req.GetNodeId()
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "node id is nil")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is nil")
+	}
+	if err := cs.checkVolumeCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	util.VolumeNameMutex.LockKey(volumeID)
+	defer func() {
+		if err := util.VolumeNameMutex.UnlockKey(volumeID); err != nil {
+			glog.Warningf("failed to unlock mutex volume:%s %v", volumeID, err)
+		}
+	}()
+
+	s, nfsVol, err := cs.findVolume(ctx, volumeID)
+	if err == nil && s == nil {
+		// a statically provisioned volume is tracked from its first
+		// publication on
+		s, nfsVol, err = cs.findContextVolume(ctx, volumeID, req.GetVolumeContext())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	}
+	if s.exportsFile != "" {
+		if err := validateExportClient(nodeID); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	pub := publication{AccessMode: mode.String(), Readonly: req.GetReadonly()}
+	if existing, ok := nfsVol.Publications[nodeID]; ok {
+		if existing != pub {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s is published to node %s as %s readonly %v",
+				volumeID, nodeID, existing.AccessMode, existing.Readonly)
+		}
+		// the exports may not have been reloaded by the earlier request
+		if err := cs.syncExports(ctx, s); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext(s, nfsVol)}, nil
+	}
+
+	for node, p := range nfsVol.Publications {
+		if isSingleNode(mode) || isSingleNode(p.mode()) {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published to node %s as %s", volumeID, node, p.AccessMode)
+		}
+		singleWriter := mode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER ||
+			p.mode() == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER
+		if singleWriter && !pub.Readonly && !p.Readonly {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published for writing to node %s", volumeID, node)
+		}
+	}
+
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	if nfsVol.Publications == nil {
+		nfsVol.Publications = make(map[string]publication)
+	}
+	nfsVol.Publications[nodeID] = pub
+	if err := saveVolume(s, nfsVol); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := cs.syncExports(ctx, s); err != nil {
+		glog.Errorf("failed to export volume %s to node %s: %v", volumeID, nodeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("volume %s published to node %s as %s", volumeID, nodeID, pub.AccessMode)
+
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext(s, nfsVol)}, nil
+}
+
+// publishContext tells the node to mount the export of the volume directory
+// on backends with an exports file, the backend root is only exported to the
+// controller
+func publishContext(s *nfsServer, nfsVol *nfsVolume) map[string]string {
+	if s.exportsFile == "" {
+		return nil
+	}
+	return map[string]string{
+		"server": s.server,
+		"share":  filepath.Join(s.path, nfsVol.subDir()),
+	}
+}
+
+// ControllerUnpublishVolume removes the node, or all nodes if none is
+// given, from the nodes the volume is published to and revokes their
+// access on backends with an exports file
+func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	glog.Infof("ControllerUnpublishVolume req: %v node: %v", req.GetVolumeId(), req.GetNodeId())
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+
+	util.VolumeNameMutex.LockKey(volumeID)
+	defer func() {
+		if err := util.VolumeNameMutex.UnlockKey(volumeID); err != nil {
+			glog.Warningf("failed to unlock mutex volume:%s %v", volumeID, err)
+		}
+	}()
+
+	s, nfsVol, err := cs.findVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	_, published := nfsVol.Publications[req.GetNodeId()]
+	if len(nfsVol.Publications) == 0 || (!published && req.GetNodeId() != "") {
+		// the exports may not have been reloaded by the earlier request
+		if err := cs.syncExports(ctx, s); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	if req.GetNodeId() == "" {
+		nfsVol.Publications = nil
+	} else {
+		delete(nfsVol.Publications, req.GetNodeId())
+	}
+	if err := saveVolume(s, nfsVol); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := cs.syncExports(ctx, s); err != nil {
+		glog.Errorf("failed to revoke export of volume %s: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("volume %s unpublished from node %s", volumeID, req.GetNodeId())
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
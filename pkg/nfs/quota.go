@@ -0,0 +1,227 @@
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/utils/exec"
+)
+
+const (
+	// project IDs below projectIDBase are left to the administrator
+	projectIDBase = 1000
+
+	xfsMagic  = 0x58465342
+	ext4Magic = 0xEF53
+)
+
+// projectLock serializes the project ID records of all backends, backends
+// on the same filesystem share its project IDs
+var projectLock sync.Mutex
+
+// projectRecords maps volume IDs to their project IDs
+type projectRecords map[string]uint32
+
+func projectRecordsPath(s *nfsServer) string {
+	return filepath.Join(s.localPath(), metadataDir, "projects.json")
+}
+
+// allocateProjectID assigns the lowest project ID free on the filesystem of
+// the backend to a volume and records it on the backend, a volume keeps the
+// ID it already has. The IDs recorded by the other backends on the same
+// filesystem are in use.
+func allocateProjectID(s *nfsServer, backends []*nfsServer, volID string) (uint32, error) {
+	projectLock.Lock()
+	defer projectLock.Unlock()
+
+	projects := projectRecords{}
+	if err := readRecord(projectRecordsPath(s), &projects); err != nil && !os.IsNotExist(err) {
+		return 0, errors.Wrap(err, "read project records")
+	}
+	if id, ok := projects[volID]; ok {
+		return id, nil
+	}
+
+	used := make(map[uint32]bool, len(projects))
+	for _, id := range projects {
+		used[id] = true
+	}
+	for _, b := range backends {
+		if b == s || !b.projectQuota || !sameFilesystem(s.localPath(), b.localPath()) {
+			continue
+		}
+		shared := projectRecords{}
+		if err := readRecord(projectRecordsPath(b), &shared); err != nil && !os.IsNotExist(err) {
+			return 0, errors.Wrapf(err, "read project records of nfs backend %s", b)
+		}
+		for _, id := range shared {
+			used[id] = true
+		}
+	}
+	id := uint32(projectIDBase)
+	for used[id] {
+		id++
+	}
+
+	projects[volID] = id
+	if err := writeRecord(projectRecordsPath(s), projects); err != nil {
+		return 0, errors.Wrap(err, "save project records")
+	}
+	return id, nil
+}
+
+// releaseProjectID removes the project ID of a volume from the records
+func releaseProjectID(s *nfsServer, volID string) error {
+	projectLock.Lock()
+	defer projectLock.Unlock()
+
+	projects := projectRecords{}
+	if err := readRecord(projectRecordsPath(s), &projects); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "read project records")
+	}
+	if _, ok := projects[volID]; !ok {
+		return nil
+	}
+
+	delete(projects, volID)
+	if err := writeRecord(projectRecordsPath(s), projects); err != nil {
+		return errors.Wrap(err, "save project records")
+	}
+	return nil
+}
+
+// sameFilesystem returns true if both paths are on the same device, a path
+// which cannot be checked is taken to be
+func sameFilesystem(a, b string) bool {
+	var sa, sb unix.Stat_t
+	if unix.Stat(a, &sa) != nil || unix.Stat(b, &sb) != nil {
+		return true
+	}
+	return sa.Dev == sb.Dev
+}
+
+// setVolumeQuota gives the volume directory its own project with a hard
+// block limit of the volume size
+func setVolumeQuota(s *nfsServer, backends []*nfsServer, nfsVol *nfsVolume, dir string) error {
+	id, err := allocateProjectID(s, backends, nfsVol.VolID)
+	if err != nil {
+		return err
+	}
+	if err := setProjectQuota(dir, id, nfsVol.VolSize); err != nil {
+		return err
+	}
+
+	nfsVol.ProjectID = id
+	glog.Infof("volume %s has project %d limited to %d bytes", nfsVol.VolID, id, nfsVol.VolSize)
+	return nil
+}
+
+// releaseVolumeQuota removes the limit and the project of the volume
+// directory and frees its project ID
+func releaseVolumeQuota(s *nfsServer, nfsVol *nfsVolume, dir string) error {
+	if nfsVol.ProjectID == 0 {
+		return nil
+	}
+	if err := clearProjectQuota(dir, nfsVol.ProjectID); err != nil {
+		return err
+	}
+	if err := releaseProjectID(s, nfsVol.VolID); err != nil {
+		return err
+	}
+
+	nfsVol.ProjectID = 0
+	return nil
+}
+
+// setProjectQuota assigns the project to dir and everything below it and
+// limits the blocks of the project to bytes
+func setProjectQuota(dir string, id uint32, bytes int64) error {
+	if err := xfsQuota(dir, fmt.Sprintf("project -s -p %s %d", dir, id)); err != nil {
+		return err
+	}
+	return limitProjectQuota(dir, id, bytes)
+}
+
+// limitProjectQuota changes the hard block limit of the project of dir
+func limitProjectQuota(dir string, id uint32, bytes int64) error {
+	return xfsQuota(dir, fmt.Sprintf("limit -p bhard=%d %d", bytes, id))
+}
+
+// clearProjectQuota removes the limit of the project and clears the
+// project of dir, the directory itself may already be removed
+func clearProjectQuota(dir string, id uint32) error {
+	if err := xfsQuota(dir, fmt.Sprintf("limit -p bhard=0 %d", id)); err != nil {
+		return err
+	}
+	if exists, _ := mount.PathExists(dir); !exists {
+		return nil
+	}
+	return xfsQuota(dir, fmt.Sprintf("project -C -p %s %d", dir, id))
+}
+
+// xfsQuota runs an xfs_quota expert command on the filesystem holding dir
+func xfsQuota(dir, command string) error {
+	mountPoint, fsType, err := quotaFilesystem(dir)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-x"}
+	if fsType != xfsMagic {
+		// project quota of ext4 is handled as a foreign filesystem
+		args = append(args, "-f")
+	}
+	args = append(args, "-c", command, mountPoint)
+
+	out, err := exec.New().Command("xfs_quota", args...).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("xfs_quota %s failed: %v, output: %s", strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+// quotaFilesystem returns the mount point and the type of the filesystem
+// holding dir, which must support project quota
+func quotaFilesystem(dir string) (string, int64, error) {
+	// the directory may be gone when its quota is released
+	path := dir
+	for {
+		if exists, _ := mount.PathExists(path); exists || path == "/" {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+
+	statfs := &unix.Statfs_t{}
+	if err := unix.Statfs(path, statfs); err != nil {
+		return "", 0, err
+	}
+	if fsType := int64(statfs.Type); fsType != xfsMagic && fsType != ext4Magic {
+		return "", 0, errors.Errorf("%s is not on xfs or ext4, project quota is not supported", dir)
+	}
+
+	mps, err := mount.New("").List()
+	if err != nil {
+		return "", 0, err
+	}
+	mountPoint := ""
+	for _, mp := range mps {
+		if (path == mp.Path || strings.HasPrefix(path, strings.TrimSuffix(mp.Path, "/")+"/")) && len(mp.Path) > len(mountPoint) {
+			mountPoint = mp.Path
+		}
+	}
+	if mountPoint == "" {
+		return "", 0, errors.Errorf("no mount point found for %s", dir)
+	}
+	return mountPoint, int64(statfs.Type), nil
+}
@@ -0,0 +1,117 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestServer(t *testing.T) (*nfsServer, func()) {
+	dir, err := ioutil.TempDir("", "csi-nfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &nfsServer{server: "127.0.0.1", path: "/export", local: dir, overcommitRatio: 1}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestProjectIDs(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	steps := []struct {
+		op    string
+		volID string
+		want  uint32
+	}{
+		{"allocate", "vol-a", projectIDBase},
+		{"allocate", "vol-b", projectIDBase + 1},
+		// a volume keeps its ID
+		{"allocate", "vol-a", projectIDBase},
+		{"release", "vol-a", 0},
+		// released IDs are taken again, lowest first
+		{"allocate", "vol-c", projectIDBase},
+		{"allocate", "vol-d", projectIDBase + 2},
+		// releasing a volume without an ID does nothing
+		{"release", "vol-unknown", 0},
+		{"release", "vol-b", 0},
+		{"release", "vol-b", 0},
+		{"allocate", "vol-e", projectIDBase + 1},
+	}
+	for i, step := range steps {
+		switch step.op {
+		case "allocate":
+			id, err := allocateProjectID(s, nil, step.volID)
+			if err != nil {
+				t.Fatalf("step %d: allocate %s: %v", i, step.volID, err)
+			}
+			if id != step.want {
+				t.Errorf("step %d: allocate %s got %d, want %d", i, step.volID, id, step.want)
+			}
+		case "release":
+			if err := releaseProjectID(s, step.volID); err != nil {
+				t.Fatalf("step %d: release %s: %v", i, step.volID, err)
+			}
+		}
+	}
+
+	projects := projectRecords{}
+	if err := readRecord(projectRecordsPath(s), &projects); err != nil {
+		t.Fatal(err)
+	}
+	want := projectRecords{"vol-c": projectIDBase, "vol-d": projectIDBase + 2, "vol-e": projectIDBase + 1}
+	if len(projects) != len(want) {
+		t.Fatalf("got records %v, want %v", projects, want)
+	}
+	for volID, id := range want {
+		if projects[volID] != id {
+			t.Errorf("got records %v, want %v", projects, want)
+			break
+		}
+	}
+}
+
+func TestReleaseProjectIDWithoutRecords(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := releaseProjectID(s, "vol-a"); err != nil {
+		t.Errorf("release without records: %v", err)
+	}
+	if _, err := os.Stat(projectRecordsPath(s)); !os.IsNotExist(err) {
+		t.Errorf("release without records wrote %s", projectRecordsPath(s))
+	}
+}
+
+func TestProjectIDsSharedFilesystem(t *testing.T) {
+	a, cleanup := newTestServer(t)
+	defer cleanup()
+	// a second backend on the same filesystem
+	b := &nfsServer{server: "127.0.0.1", path: "/export/b", local: filepath.Join(a.local, "b"), projectQuota: true, overcommitRatio: 1}
+	a.projectQuota = true
+	if err := os.Mkdir(b.local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	backends := []*nfsServer{a, b}
+
+	steps := []struct {
+		s     *nfsServer
+		volID string
+		want  uint32
+	}{
+		{a, "vol-a", projectIDBase},
+		{b, "vol-b", projectIDBase + 1},
+		{a, "vol-c", projectIDBase + 2},
+		{b, "vol-d", projectIDBase + 3},
+	}
+	for i, step := range steps {
+		id, err := allocateProjectID(step.s, backends, step.volID)
+		if err != nil {
+			t.Fatalf("step %d: allocate %s: %v", i, step.volID, err)
+		}
+		if id != step.want {
+			t.Errorf("step %d: allocate %s got %d, want %d", i, step.volID, id, step.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package nfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/keymutex"
+)
+
+const (
+	// backend mounts unused for mountIdleTimeout are unmounted
+	mountIdleTimeout = 5 * time.Minute
+	mountReapPeriod  = time.Minute
+)
+
+// serverMount is a backend export mounted by the controller
+type serverMount struct {
+	refs     int
+	lastUsed time.Time
+}
+
+// serverMounter mounts backend exports on demand and shares each mount
+// between concurrent requests, idle mounts are unmounted by reap
+type serverMounter struct {
+	lock    sync.Mutex
+	mounter *ctxMounter
+	mounts  map[string]*serverMount
+	// serializes mount and unmount of the same backend
+	pathMutex keymutex.KeyMutex
+}
+
+func newServerMounter() *serverMounter {
+	return &serverMounter{
+		mounter:   newCtxMounter(),
+		mounts:    make(map[string]*serverMount),
+		pathMutex: keymutex.NewHashed(0),
+	}
+}
+
+// acquire mounts the backend at its local path if it is not mounted yet and
+// takes a reference on the mount, callers must call release when done. The
+// mount is killed when the context is done, an unreachable server fails the
+// request instead of hanging it with its locks held.
+func (m *serverMounter) acquire(ctx context.Context, s *nfsServer) error {
+	if s.local != "" {
+		if _, err := os.Stat(s.local); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return nil
+	}
+
+	target := s.localPath()
+	m.pathMutex.LockKey(target)
+	defer m.pathMutex.UnlockKey(target)
+
+	m.lock.Lock()
+	if sm, ok := m.mounts[target]; ok {
+		sm.refs++
+		m.lock.Unlock()
+		return nil
+	}
+	m.lock.Unlock()
+
+	if err := m.mount(ctx, s); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.mounts[target] = &serverMount{refs: 1}
+	m.lock.Unlock()
+
+	return nil
+}
+
+// release drops a reference taken by acquire
+func (m *serverMounter) release(s *nfsServer) {
+	if s.local != "" {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sm, ok := m.mounts[s.localPath()]
+	if !ok || sm.refs == 0 {
+		glog.Warningf("release of nfs backend %s which is not acquired", s)
+		return
+	}
+	sm.refs--
+	sm.lastUsed = time.Now()
+}
+
+func (m *serverMounter) mount(ctx context.Context, s *nfsServer) error {
+	ctx, cancel := mountContext(ctx)
+	defer cancel()
+
+	target := s.localPath()
+	notMnt, err := m.mounter.IsLikelyNotMountPointContext(ctx, target)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return mountError(err)
+		}
+		if err := os.MkdirAll(target, 0750); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		notMnt = true
+	}
+	if !notMnt {
+		// left behind by a previous run, reuse it
+		glog.Infof("nfs backend %s is already mounted at %v", s, target)
+		return nil
+	}
+
+	source := fmt.Sprintf("%s:%s", s.server, s.path)
+	if err := m.mounter.MountContext(ctx, source, target, "nfs", nil); err != nil {
+		return mountError(err)
+	}
+	glog.Infof("mount nfs %v at %v success", source, target)
+
+	return nil
+}
+
+// mountError maps a mount error to a gRPC status
+func mountError(err error) error {
+	switch errors.Cause(err) {
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if os.IsPermission(err) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if strings.Contains(err.Error(), "invalid argument") {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// reap unmounts backends which have not been used for mountIdleTimeout
+func (m *serverMounter) reap() {
+	m.lock.Lock()
+	var idle []string
+	for target, sm := range m.mounts {
+		if sm.refs == 0 && time.Since(sm.lastUsed) > mountIdleTimeout {
+			idle = append(idle, target)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, target := range idle {
+		m.unmountIdle(target)
+	}
+}
+
+func (m *serverMounter) unmountIdle(target string) {
+	m.pathMutex.LockKey(target)
+	defer m.pathMutex.UnlockKey(target)
+
+	// the mount may have been acquired again in the meantime
+	m.lock.Lock()
+	sm, ok := m.mounts[target]
+	if !ok || sm.refs > 0 || time.Since(sm.lastUsed) <= mountIdleTimeout {
+		m.lock.Unlock()
+		return
+	}
+	delete(m.mounts, target)
+	m.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultMountTimeout)
+	defer cancel()
+	if err := m.mounter.CleanupMountPointContext(ctx, target); err != nil {
+		glog.Errorf("umount %v error: %v", target, err)
+		m.lock.Lock()
+		m.mounts[target] = &serverMount{lastUsed: time.Now()}
+		m.lock.Unlock()
+		return
+	}
+	glog.Infof("umount idle nfs backend at %v success", target)
+}
+
+// run reaps idle mounts periodically, it never returns
+func (m *serverMounter) run() {
+	for range time.Tick(mountReapPeriod) {
+		m.reap()
+	}
+}
+
+// withServer runs fn with the backend mounted at a temporary local path, it
+// is meant for the command line tools which run outside of the controller
+// server. The mount of the controller at the same backend is left alone.
+func withServer(s *nfsServer, fn func() error) error {
+	if err := validateServer(s.server, s.path); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "csi-nfs-")
+	if err != nil {
+		return err
+	}
+	m := newCtxMounter()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultMountTimeout)
+	defer cancel()
+	source := fmt.Sprintf("%s:%s", s.server, s.path)
+	if err := m.MountContext(ctx, source, dir, "nfs", nil); err != nil {
+		os.Remove(dir)
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultMountTimeout)
+		defer cancel()
+		if err := m.CleanupMountPointContext(ctx, dir); err != nil {
+			glog.Errorf("umount %v error: %v", dir, err)
+		}
+	}()
+
+	s.local = dir
+	return fn()
+}
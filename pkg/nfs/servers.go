@@ -0,0 +1,207 @@
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// nfsServerConfig is one entry of the backend config file
+type nfsServerConfig struct {
+	Server string `json:"server"`
+	Share  string `json:"share"`
+	// ReserveProvisioned makes GetCapacity report the free space minus the
+	// size promised to provisioned volumes
+	ReserveProvisioned bool `json:"reserveProvisioned"`
+	// OvercommitRatio is how many times the backend capacity may be
+	// promised to volumes, 1 when not set
+	OvercommitRatio float64 `json:"overcommitRatio"`
+	// LocalPath is where the export is reachable in the controller without
+	// an NFS mount, for a controller running on the NFS server
+	LocalPath string `json:"localPath"`
+	// ProjectQuota limits each volume to its size with a project quota, the
+	// export must be on xfs or ext4 and reachable through LocalPath
+	ProjectQuota bool `json:"projectQuota"`
+	// Topology lists the segments, e.g. the zone, the backend is reachable
+	// from, it is reachable from everywhere when not set
+	Topology map[string]string `json:"topology"`
+	// ExportsFile is an exports file on the NFS server the controller
+	// renders from the publications of the volumes, the nodes a volume is
+	// published to are granted access to its directory
+	ExportsFile string `json:"exportsFile"`
+	// ExportsReloadCommand makes the NFS server read ExportsFile again,
+	// exportfs -ra when not set
+	ExportsReloadCommand []string `json:"exportsReloadCommand"`
+	// ExportOptions are the options of each export, rw,sync,no_subtree_check
+	// when not set
+	ExportOptions string `json:"exportOptions"`
+}
+
+// loadServerConfig reads the list of NFS backends from a JSON file
+func loadServerConfig(file string) ([]*nfsServer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read backend config %s", file)
+	}
+
+	var configs []nfsServerConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, errors.Wrapf(err, "parse backend config %s", file)
+	}
+
+	servers := make([]*nfsServer, 0, len(configs))
+	for _, c := range configs {
+		if c.ProjectQuota && c.LocalPath == "" {
+			return nil, errors.Errorf("projectQuota of nfs backend %s requires localPath", serverKey(c.Server, c.Share))
+		}
+		if c.OvercommitRatio < 0 {
+			return nil, errors.Errorf("invalid overcommitRatio %v of nfs backend %s", c.OvercommitRatio, serverKey(c.Server, c.Share))
+		}
+		if err := validateTopology(c.Topology); err != nil {
+			return nil, errors.Wrapf(err, "nfs backend %s", serverKey(c.Server, c.Share))
+		}
+		if c.ExportsFile != "" && !filepath.IsAbs(c.ExportsFile) {
+			return nil, errors.Errorf("exportsFile of nfs backend %s must be an absolute path", serverKey(c.Server, c.Share))
+		}
+		if len(c.ExportsReloadCommand) == 0 {
+			c.ExportsReloadCommand = defaultExportsReloadCommand
+		}
+		if c.ExportOptions == "" {
+			c.ExportOptions = defaultExportOptions
+		}
+		if strings.ContainsAny(c.ExportOptions, " \t()") {
+			return nil, errors.Errorf("invalid exportOptions %q of nfs backend %s", c.ExportOptions, serverKey(c.Server, c.Share))
+		}
+		servers = append(servers, &nfsServer{
+			server:             c.Server,
+			path:               c.Share,
+			reserveProvisioned: c.ReserveProvisioned,
+			overcommitRatio:    c.OvercommitRatio,
+			local:              c.LocalPath,
+			projectQuota:       c.ProjectQuota,
+			topology:           c.Topology,
+			exportsFile:        c.ExportsFile,
+			exportsReload:      c.ExportsReloadCommand,
+			exportOpts:         c.ExportOptions,
+		})
+	}
+	return servers, nil
+}
+
+// serverKey returns the key of a backend in ControllerServer.nfsInfo
+func serverKey(server, share string) string {
+	return fmt.Sprintf("%s:%s", server, share)
+}
+
+func (s *nfsServer) String() string {
+	return serverKey(s.server, s.path)
+}
+
+// localPath returns where the export is reachable inside the controller
+func (s *nfsServer) localPath() string {
+	if s.local != "" {
+		return s.local
+	}
+	return filepath.Join(mountPath, s.server, s.path)
+}
+
+// validateServer checks the server address and export path of a backend
+func validateServer(server, share string) error {
+	if server == "" {
+		return errors.New("nfs server is empty")
+	}
+	if net.ParseIP(server) == nil {
+		if msgs := validation.IsDNS1123Subdomain(strings.ToLower(server)); len(msgs) > 0 {
+			return errors.Errorf("invalid nfs server %q: %s", server, strings.Join(msgs, ", "))
+		}
+	}
+
+	if share == "" {
+		return errors.New("nfs share is empty")
+	}
+	if !filepath.IsAbs(share) || filepath.Clean(share) != share {
+		return errors.Errorf("nfs share %q must be a clean absolute path", share)
+	}
+	if strings.Contains(share, volumeIDSep) {
+		return errors.Errorf("nfs share %q must not contain %q", share, volumeIDSep)
+	}
+	return nil
+}
+
+// registerServer validates a backend and adds it to nfsInfo, the first
+// registered backend becomes the default one. The already registered
+// backend is returned if there is one with the same server and share.
+func (cs *ControllerServer) registerServer(s *nfsServer) (*nfsServer, error) {
+	if err := validateServer(s.server, s.path); err != nil {
+		return nil, err
+	}
+	if s.overcommitRatio == 0 {
+		s.overcommitRatio = 1
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	key := s.String()
+	if registered, ok := cs.nfsInfo[key]; ok {
+		return registered, nil
+	}
+	cs.nfsInfo[key] = s
+	if cs.defaultServer == "" {
+		cs.defaultServer = key
+	}
+	glog.Infof("registered nfs backend %s", key)
+
+	return s, nil
+}
+
+// getServer returns the backend selected by the server and share parameters,
+// or the default backend when neither is given. Backends which are not
+// registered yet are registered on first use.
+func (cs *ControllerServer) getServer(server, share string) (*nfsServer, error) {
+	if server == "" && share == "" {
+		cs.lock.RLock()
+		defer cs.lock.RUnlock()
+
+		s, ok := cs.nfsInfo[cs.defaultServer]
+		if !ok {
+			return nil, status.Error(codes.FailedPrecondition, "no nfs backend is registered")
+		}
+		return s, nil
+	}
+
+	if server == "" || share == "" {
+		return nil, status.Error(codes.InvalidArgument, "parameters server and share must be set together")
+	}
+
+	s, err := cs.registerServer(&nfsServer{server: server, path: share})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s, nil
+}
+
+// listServers returns all registered backends sorted by key
+func (cs *ControllerServer) listServers() []*nfsServer {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	servers := make([]*nfsServer, 0, len(cs.nfsInfo))
+	for _, s := range cs.nfsInfo {
+		servers = append(servers, s)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].String() < servers[j].String()
+	})
+	return servers
+}
@@ -0,0 +1,334 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/zhonglin6666/kube-nfs-csi/pkg/util"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	snapshotIDPrefix = "csi-nfs-snap-"
+	snapshotsDir     = "snapshots"
+)
+
+// nfsSnapshot is the record of a point-in-time copy of a volume directory,
+// the copy is kept in the snapshots area of the backend of the volume
+type nfsSnapshot struct {
+	SnapName     string    `json:"snapName"`
+	SnapID       string    `json:"snapID"`
+	SourceVolID  string    `json:"sourceVolID"`
+	Server       string    `json:"server"`
+	Share        string    `json:"share"`
+	SizeBytes    int64     `json:"sizeBytes"`
+	CreationTime time.Time `json:"creationTime"`
+	ReadyToUse   bool      `json:"readyToUse"`
+}
+
+func snapshotsPath(s *nfsServer) string {
+	return filepath.Join(s.localPath(), metadataDir, snapshotsDir)
+}
+
+// snapshotDataPath returns the directory holding the copy of a snapshot
+func snapshotDataPath(s *nfsServer, snapID string) string {
+	return filepath.Join(snapshotsPath(s), snapID)
+}
+
+func snapshotRecordPath(s *nfsServer, snapID string) string {
+	return filepath.Join(snapshotsPath(s), snapID+".json")
+}
+
+// snapshotIDFromName returns the snapshot ID of the CSI request name
+func snapshotIDFromName(name string) string {
+	return snapshotIDPrefix + uuid.NewSHA1(uuid.NameSpace_OID, []byte(name)).String()
+}
+
+func loadSnapshot(s *nfsServer, snapID string) (*nfsSnapshot, error) {
+	snap := &nfsSnapshot{}
+	if err := readRecord(snapshotRecordPath(s, snapID), snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// listBackendSnapshots returns the snapshot records of a backend sorted by ID
+func listBackendSnapshots(s *nfsServer) ([]*nfsSnapshot, error) {
+	entries, err := ioutil.ReadDir(snapshotsPath(s))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var snaps []*nfsSnapshot
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		snap, err := loadSnapshot(s, strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			glog.Warningf("skip unreadable snapshot record %s: %v", e.Name(), err)
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].SnapID < snaps[j].SnapID
+	})
+	return snaps, nil
+}
+
+func (snap *nfsSnapshot) toCSI() (*csi.Snapshot, error) {
+	creationTime, err := ptypes.TimestampProto(snap.CreationTime)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.Snapshot{
+		SnapshotId:     snap.SnapID,
+		SourceVolumeId: snap.SourceVolID,
+		SizeBytes:      snap.SizeBytes,
+		CreationTime:   creationTime,
+		ReadyToUse:     snap.ReadyToUse,
+	}, nil
+}
+
+// findSnapshot returns the backend and the record of a snapshot, the
+// backend is nil if no registered backend has the snapshot
+func (cs *ControllerServer) findSnapshot(ctx context.Context, snapID string) (*nfsServer, *nfsSnapshot, error) {
+	for _, s := range cs.listServers() {
+		if err := cs.mounts.acquire(ctx, s); err != nil {
+			glog.Warningf("skip nfs backend %s when looking up snapshot %s: %v", s, snapID, err)
+			continue
+		}
+		snap, err := loadSnapshot(s, snapID)
+		cs.mounts.release(s)
+		if err == nil {
+			return s, snap, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return nil, nil, nil
+}
+
+// CreateSnapshot copies the volume directory into the snapshots area of
+// its backend
+func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	glog.Infof("CreateSnapshot req: %v", protosanitizer.StripSecrets(req))
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.Warningf("invalid create snapshot req: %v", protosanitizer.StripSecrets(req))
+		return nil, err
+	}
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name cannot be empty")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "source volume id cannot be empty")
+	}
+
+	util.VolumeNameMutex.LockKey(req.GetName())
+	defer func() {
+		if err := util.VolumeNameMutex.UnlockKey(req.GetName()); err != nil {
+			glog.Warningf("failed to unlock mutex snapshot:%s %v", req.GetName(), err)
+		}
+	}()
+
+	s, nfsVol, err := cs.findVolume(ctx, req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, status.Errorf(codes.NotFound, "source volume %s not found", req.GetSourceVolumeId())
+	}
+
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	snapID := snapshotIDFromName(req.GetName())
+	snap, err := loadSnapshot(s, snapID)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if snap != nil {
+		if snap.SourceVolID != nfsVol.VolID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", req.GetName(), snap.SourceVolID)
+		}
+		if snap.ReadyToUse {
+			csiSnap, err := snap.toCSI()
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			return &csi.CreateSnapshotResponse{Snapshot: csiSnap}, nil
+		}
+		// left behind by an interrupted copy, start over
+		glog.Warningf("snapshot %s was not completed, copying again", snapID)
+	}
+
+	snap = &nfsSnapshot{
+		SnapName:     req.GetName(),
+		SnapID:       snapID,
+		SourceVolID:  nfsVol.VolID,
+		Server:       s.server,
+		Share:        s.path,
+		CreationTime: time.Now().UTC(),
+	}
+	if err := writeRecord(snapshotRecordPath(s, snapID), snap); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	dataPath := snapshotDataPath(s, snapID)
+	if err := os.RemoveAll(dataPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	size, err := util.CopyTree(volumeDir(s, nfsVol), dataPath)
+	if err != nil {
+		glog.Errorf("failed to copy volume %s to snapshot %s: %v", nfsVol.VolID, snapID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	snap.SizeBytes = size
+	snap.ReadyToUse = true
+	if err := writeRecord(snapshotRecordPath(s, snapID), snap); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("create snapshot %s of volume %s success, size: %d", snapID, nfsVol.VolID, size)
+
+	csiSnap, err := snap.toCSI()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnap}, nil
+}
+
+// DeleteSnapshot removes the copy and the record of a snapshot
+func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	glog.Infof("DeleteSnapshot req: %v", req.GetSnapshotId())
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.Warningf("invalid delete snapshot req: %v", protosanitizer.StripSecrets(req))
+		return nil, err
+	}
+	snapID := req.GetSnapshotId()
+	if snapID == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot id cannot be empty")
+	}
+	if !strings.HasPrefix(snapID, snapshotIDPrefix) || strings.Contains(snapID, "/") {
+		glog.Warningf("snapshot %s is not a snapshot of this driver, deletion skipped", snapID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	util.VolumeNameMutex.LockKey(snapID)
+	defer func() {
+		if err := util.VolumeNameMutex.UnlockKey(snapID); err != nil {
+			glog.Warningf("failed to unlock mutex snapshot:%s %v", snapID, err)
+		}
+	}()
+
+	s, _, err := cs.findSnapshot(ctx, snapID)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		glog.Warningf("snapshot %s not found on any nfs backend, deletion skipped", snapID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	if err := os.RemoveAll(snapshotDataPath(s, snapID)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := os.Remove(snapshotRecordPath(s, snapID)); err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("delete snapshot %s success", snapID)
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots returns the snapshots of all registered backends, filtered
+// by snapshot or source volume and ordered like ListVolumes
+func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		glog.Warningf("invalid list snapshots req: %v", req)
+		return nil, err
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+
+	var start string
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		if start, err = decodeListToken(token); err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+
+	resp := &csi.ListSnapshotsResponse{}
+	for _, s := range cs.listServers() {
+		snaps, err := cs.listServerSnapshots(ctx, s)
+		if err != nil {
+			glog.Warningf("skip nfs backend %s when listing snapshots: %v", s, err)
+			continue
+		}
+
+		for _, snap := range snaps {
+			if req.GetSnapshotId() != "" && snap.SnapID != req.GetSnapshotId() {
+				continue
+			}
+			if req.GetSourceVolumeId() != "" && snap.SourceVolID != req.GetSourceVolumeId() {
+				continue
+			}
+			key := listKey(s, snap.SnapID)
+			if key < start {
+				continue
+			}
+			if req.GetMaxEntries() > 0 && len(resp.Entries) == int(req.GetMaxEntries()) {
+				resp.NextToken = encodeListToken(key)
+				return resp, nil
+			}
+
+			csiSnap, err := snap.toCSI()
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnap})
+		}
+	}
+
+	return resp, nil
+}
+
+func (cs *ControllerServer) listServerSnapshots(ctx context.Context, s *nfsServer) ([]*nfsSnapshot, error) {
+	if err := cs.mounts.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	defer cs.mounts.release(s)
+
+	snaps, err := listBackendSnapshots(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "list snapshots")
+	}
+	return snaps, nil
+}
@@ -0,0 +1,242 @@
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// the staged volumes are checked for stale mounts every healthCheckPeriod
+	healthCheckPeriod = time.Minute
+)
+
+// isStale returns true for the errors of a mount whose server failed over
+// or went away, a stale file handle or a disconnected transport
+func isStale(err error) bool {
+	if err == nil {
+		return false
+	}
+	errno := err
+	switch e := err.(type) {
+	case *os.PathError:
+		errno = e.Err
+	case *os.SyscallError:
+		errno = e.Err
+	}
+	if errno == syscall.ESTALE || errno == syscall.ENOTCONN {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "stale file handle") || strings.Contains(msg, "transport endpoint is not connected")
+}
+
+// forceUnmount unmounts a path whose server does not answer, lazily if the
+// forced unmount fails. A path which is not mounted is left alone.
+func forceUnmount(path string) error {
+	err := unix.Unmount(path, unix.MNT_FORCE)
+	if err == nil || err == unix.EINVAL || err == unix.ENOENT {
+		return nil
+	}
+	glog.Warningf("force umount %v error: %v, umount it lazily", path, err)
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// repairVolume remounts the export a volume is staged from after path, a
+// staging path or target of the volume, was found stale. A stale path of a
+// volume which is not staged is only unmounted.
+func (m *exportMounter) repairVolume(ctx context.Context, volumeID, path string) error {
+	e, err := m.volumeExport(volumeID)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if e == nil {
+		if err := forceUnmount(path); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("repair stale mount %v of volume %v: unmounted", path, volumeID)
+		return nil
+	}
+	return m.repair(ctx, filepath.Base(e.Path))
+}
+
+// repair remounts a stale export and the staging paths and targets bind
+// mounted from it
+func (m *exportMounter) repair(ctx context.Context, key string) error {
+	m.keyMutex.LockKey(key)
+	defer m.keyMutex.UnlockKey(key)
+
+	return m.repairLocked(ctx, key)
+}
+
+func (m *exportMounter) repairLocked(ctx context.Context, key string) error {
+	exports, err := m.list()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	e, ok := exports[key]
+	if !ok {
+		// nothing was staged from the export, it is mounted again by the
+		// next stage
+		path := filepath.Join(m.stateDir, "exports", key)
+		if err := forceUnmount(path); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("repair stale nfs export at %v: unmounted", path)
+		return nil
+	}
+
+	// the export is mounted again before the bind mounts are touched, they
+	// are left as they are when it fails and the next health check retries
+	remounted := false
+	if m.lostMount(ctx, e.Path) {
+		if err := forceUnmount(e.Path); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := m.mountExport(ctx, e); err != nil {
+			return err
+		}
+		glog.Infof("repair stale nfs export %v: remounted at %v with nfs version %v", e.source(), e.Path, e.Version)
+		remounted = true
+	}
+
+	// the bind mounts of a remounted export keep the stale mount, they are
+	// all mounted again. A path which cannot be mounted again does not keep
+	// the others from being repaired, it is still lost for the next health
+	// check.
+	var failed []string
+	for volumeID, v := range e.Volumes {
+		if v.StagingPath == "" {
+			continue
+		}
+		staged := false
+		if remounted || m.lostMount(ctx, v.StagingPath) {
+			if err := m.rebind(ctx, filepath.Join(e.Path, v.SubDir), v.StagingPath, nil); err != nil {
+				glog.Errorf("repair stale volume %v: mount staging path %v error: %v", volumeID, v.StagingPath, err)
+				failed = append(failed, v.StagingPath)
+				continue
+			}
+			staged = true
+		}
+		targets := 0
+		for target, readonly := range v.Targets {
+			if !staged && !m.lostMount(ctx, target) {
+				continue
+			}
+			var options []string
+			if readonly {
+				options = append(options, "ro")
+			}
+			if err := m.rebind(ctx, v.StagingPath, target, options); err != nil {
+				glog.Errorf("repair stale volume %v: mount target %v error: %v", volumeID, target, err)
+				failed = append(failed, target)
+				continue
+			}
+			targets++
+		}
+		if staged || targets > 0 {
+			glog.Infof("repair stale volume %v: remounted staging path %v: %v and %d targets", volumeID, v.StagingPath, staged, targets)
+		}
+	}
+
+	if remounted {
+		err = m.update(func(exports map[string]*exportMount) {
+			if current, ok := exports[key]; ok {
+				current.Version = e.Version
+			}
+		})
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return status.Errorf(codes.Internal, "mount %s of nfs export %v again failed", strings.Join(failed, ", "), e.source())
+	}
+	return nil
+}
+
+// rebind replaces the mount at target with a bind mount of source
+func (m *exportMounter) rebind(ctx context.Context, source, target string, options []string) error {
+	if err := forceUnmount(target); err != nil {
+		return err
+	}
+	return m.mounter.MountContext(ctx, source, target, "", append([]string{"bind"}, options...))
+}
+
+// lostMount returns true if path is stale or was unmounted. A path which
+// does not answer before the context is done is neither, the server may
+// only be slow.
+func (m *exportMounter) lostMount(ctx context.Context, path string) bool {
+	notMnt, err := m.mounter.IsLikelyNotMountPointContext(ctx, path)
+	if err != nil {
+		if isStale(err) {
+			glog.Warningf("mount %v is stale, err %v", path, err)
+		}
+		return isStale(err)
+	}
+	if notMnt {
+		glog.Warningf("mount %v is lost", path)
+	}
+	return notMnt
+}
+
+// needsRepair returns true if the export or a path bind mounted from it is
+// stale or lost, a failed repair leaves them lost
+func (m *exportMounter) needsRepair(ctx context.Context, e *exportMount) bool {
+	paths := []string{e.Path}
+	for _, v := range e.Volumes {
+		if v.StagingPath != "" {
+			paths = append(paths, v.StagingPath)
+		}
+		for target := range v.Targets {
+			paths = append(paths, target)
+		}
+	}
+	for _, path := range paths {
+		if m.lostMount(ctx, path) {
+			glog.Warningf("nfs export %v needs repair", e.source())
+			return true
+		}
+	}
+	return false
+}
+
+// checkHealth repairs the exports with stale or lost mounts
+func (m *exportMounter) checkHealth() {
+	exports, err := m.list()
+	if err != nil {
+		glog.Errorf("list nfs exports error: %v", err)
+		return
+	}
+	for key, e := range exports {
+		checkCtx, cancel := context.WithTimeout(context.Background(), defaultMountTimeout)
+		repair := m.needsRepair(checkCtx, e)
+		cancel()
+		if !repair {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultMountTimeout)
+		if err := m.repair(ctx, key); err != nil {
+			glog.Errorf("repair stale nfs export %v error: %v", e.source(), err)
+		}
+		cancel()
+	}
+}
+
+// run checks the staged volumes periodically, it never returns
+func (m *exportMounter) run() {
+	for range time.Tick(healthCheckPeriod) {
+		m.checkHealth()
+	}
+}
@@ -0,0 +1,114 @@
+package nfs
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// topologyZoneKey is the segment nodes report their zone with
+	topologyZoneKey = "topology." + driverName + "/zone"
+)
+
+// validateTopology checks the topology segments of a backend, nodes only
+// report topologyZoneKey so no node would match another key
+func validateTopology(segments map[string]string) error {
+	for k, v := range segments {
+		if k != topologyZoneKey {
+			return errors.Errorf("topology key %q is not supported, nodes only report %s", k, topologyZoneKey)
+		}
+		if msgs := validation.IsValidLabelValue(v); len(msgs) > 0 {
+			return errors.Errorf("invalid topology value %q of key %s: %v", v, k, msgs)
+		}
+	}
+	return nil
+}
+
+// accessibleTopology returns the topology the backend is reachable from,
+// nil if it is reachable from everywhere
+func (s *nfsServer) accessibleTopology() []*csi.Topology {
+	if len(s.topology) == 0 {
+		return nil
+	}
+
+	segments := make(map[string]string, len(s.topology))
+	for k, v := range s.topology {
+		segments[k] = v
+	}
+	return []*csi.Topology{{Segments: segments}}
+}
+
+// inTopology returns true if the backend is reachable from t, that is all
+// segments of the backend are part of t
+func (s *nfsServer) inTopology(t *csi.Topology) bool {
+	for k, v := range s.topology {
+		if t.GetSegments()[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// accessibleFrom returns true if the backend is reachable from one of the
+// requisite topologies, or there are none
+func (s *nfsServer) accessibleFrom(req *csi.TopologyRequirement) bool {
+	if len(req.GetRequisite()) == 0 {
+		return true
+	}
+	for _, t := range req.GetRequisite() {
+		if s.inTopology(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectServer returns the backend of a new volume. A backend set with the
+// server and share parameters must be reachable from the requisite
+// topologies. Otherwise the first backend reachable from the preferred
+// topologies, then from the requisite ones is chosen, the default backend
+// before the others.
+func (cs *ControllerServer) selectServer(nfsVol *nfsVolume, req *csi.TopologyRequirement) (*nfsServer, error) {
+	if nfsVol.Server != "" || (len(req.GetPreferred()) == 0 && len(req.GetRequisite()) == 0) {
+		s, err := cs.getServer(nfsVol.Server, nfsVol.Share)
+		if err != nil {
+			return nil, err
+		}
+		if !s.accessibleFrom(req) {
+			return nil, status.Errorf(codes.ResourceExhausted, "nfs backend %s is not accessible from the requisite topology", s)
+		}
+		return s, nil
+	}
+
+	servers := cs.listServersDefaultFirst()
+	for _, t := range append(req.GetPreferred(), req.GetRequisite()...) {
+		for _, s := range servers {
+			if s.inTopology(t) {
+				return s, nil
+			}
+		}
+	}
+	return nil, status.Error(codes.ResourceExhausted, "no nfs backend is accessible from the requested topology")
+}
+
+// listServersDefaultFirst returns the registered backends sorted by key,
+// with the default backend first
+func (cs *ControllerServer) listServersDefaultFirst() []*nfsServer {
+	servers := cs.listServers()
+
+	cs.lock.RLock()
+	defaultServer := cs.defaultServer
+	cs.lock.RUnlock()
+
+	for i, s := range servers {
+		if s.String() == defaultServer {
+			copy(servers[1:i+1], servers[:i])
+			servers[0] = s
+			break
+		}
+	}
+	return servers
+}
@@ -0,0 +1,179 @@
+package nfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataDir keeps the driver records at the root of each backend
+	metadataDir = ".csi-nfs"
+)
+
+func volumeRecordsDir(s *nfsServer) string {
+	return filepath.Join(s.localPath(), metadataDir, "volumes")
+}
+
+// volumeRecordPath returns the record of a volume on its backend, the
+// volume ID is escaped as it may contain slashes
+func volumeRecordPath(s *nfsServer, volID string) string {
+	return filepath.Join(volumeRecordsDir(s), url.PathEscape(volID)+".json")
+}
+
+// subDir returns the directory of the volume relative to the backend root,
+// volumes created without pathPattern are named after their ID
+func (v *nfsVolume) subDir() string {
+	if v.Path != "" {
+		return v.Path
+	}
+	return v.VolID
+}
+
+// volumeDir returns the directory of a volume on its backend
+func volumeDir(s *nfsServer, nfsVol *nfsVolume) string {
+	return filepath.Join(s.localPath(), nfsVol.subDir())
+}
+
+// writeRecord stores v as JSON in file, replacing it atomically
+func writeRecord(file string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// readRecord loads a JSON record written by writeRecord
+func readRecord(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveVolume writes the record of a volume next to its directory
+func saveVolume(s *nfsServer, nfsVol *nfsVolume) error {
+	if err := writeRecord(volumeRecordPath(s, nfsVol.VolID), nfsVol); err != nil {
+		return errors.Wrapf(err, "save record of volume %s", nfsVol.VolID)
+	}
+	return nil
+}
+
+// loadVolume reads the record of a volume, the returned error satisfies
+// os.IsNotExist for volumes without a record
+func loadVolume(s *nfsServer, volID string) (*nfsVolume, error) {
+	nfsVol := &nfsVolume{}
+	if err := readRecord(volumeRecordPath(s, volID), nfsVol); err != nil {
+		return nil, err
+	}
+	return nfsVol, nil
+}
+
+// removeVolume deletes the record of a volume
+func removeVolume(s *nfsServer, volID string) error {
+	if err := os.Remove(volumeRecordPath(s, volID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// newLegacyVolume describes a volume provisioned before records were kept,
+// only its location is known
+func newLegacyVolume(s *nfsServer, volID string) *nfsVolume {
+	return &nfsVolume{
+		VolID:           volID,
+		Server:          s.server,
+		Share:           s.path,
+		ArchiveOnDelete: "false",
+	}
+}
+
+// listVolumes returns the records of all volumes of a backend sorted by ID
+func listVolumes(s *nfsServer) ([]*nfsVolume, error) {
+	entries, err := ioutil.ReadDir(volumeRecordsDir(s))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var volumes []*nfsVolume
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		volID, err := url.PathUnescape(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			glog.Warningf("skip volume record %s: %v", e.Name(), err)
+			continue
+		}
+		nfsVol, err := loadVolume(s, volID)
+		if err != nil {
+			glog.Warningf("skip unreadable volume record %s: %v", e.Name(), err)
+			continue
+		}
+		volumes = append(volumes, nfsVol)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolID < volumes[j].VolID
+	})
+	return volumes, nil
+}
+
+// ListVolumeRecords returns the records of all volumes of an NFS backend
+func ListVolumeRecords(server, share string) ([]json.RawMessage, error) {
+	s := &nfsServer{server: server, path: share}
+
+	var records []json.RawMessage
+	err := withServer(s, func() error {
+		volumes, err := listVolumes(s)
+		if err != nil {
+			return err
+		}
+		for _, v := range volumes {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			records = append(records, data)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// GetVolumeRecord returns the record of a volume of an NFS backend
+func GetVolumeRecord(server, share, volumeID string) (json.RawMessage, error) {
+	s := &nfsServer{server: server, path: share}
+
+	var record json.RawMessage
+	err := withServer(s, func() error {
+		nfsVol, err := loadVolume(s, volumeID)
+		if err != nil {
+			return errors.Wrapf(err, "read record of volume %s", volumeID)
+		}
+		record, err = json.Marshal(nfsVol)
+		return err
+	})
+	return record, err
+}
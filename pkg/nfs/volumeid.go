@@ -0,0 +1,84 @@
+package nfs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// volumeIDVersion prefixes the volume IDs which name the backend and
+	// directory of the volume: v1#<server>#<share>#<directory>
+	volumeIDVersion = "v1"
+	volumeIDSep     = "#"
+
+	// maxVolumeIDLength is the length a CO should accept for volume IDs
+	maxVolumeIDLength = 128
+)
+
+// volumeLocation is the backend and directory a volume ID names
+type volumeLocation struct {
+	server string
+	share  string
+	subDir string
+}
+
+// encodeVolumeID returns the volume ID of the directory subDir of backend s
+func encodeVolumeID(s *nfsServer, subDir string) string {
+	return strings.Join([]string{volumeIDVersion, s.server, s.path, subDir}, volumeIDSep)
+}
+
+// parseVolumeID returns the location named by a volume ID. Volume IDs of
+// the form csi-nfs-vol-<uuid> which were used before IDs named their backend
+// have no location, nil is returned for them.
+func parseVolumeID(id string) (*volumeLocation, error) {
+	if id == "" {
+		return nil, errors.New("volume id is empty")
+	}
+	if !strings.Contains(id, volumeIDSep) {
+		if strings.Contains(id, "/") || strings.HasPrefix(id, ".") {
+			return nil, errors.Errorf("invalid volume id %q", id)
+		}
+		return nil, nil
+	}
+
+	parts := strings.SplitN(id, volumeIDSep, 4)
+	if parts[0] != volumeIDVersion {
+		return nil, errors.Errorf("unsupported version %q of volume id %q", parts[0], id)
+	}
+	if len(parts) != 4 {
+		return nil, errors.Errorf("invalid volume id %q", id)
+	}
+
+	loc := &volumeLocation{server: parts[1], share: parts[2], subDir: parts[3]}
+	if err := validateServer(loc.server, loc.share); err != nil {
+		return nil, errors.Wrapf(err, "invalid volume id %q", id)
+	}
+	if err := validateSubDir(loc.subDir); err != nil {
+		return nil, errors.Wrapf(err, "invalid volume id %q", id)
+	}
+	return loc, nil
+}
+
+// validateSubDir checks that a volume directory is a relative path inside
+// its backend which is not hidden, the driver keeps its records in a hidden
+// directory
+func validateSubDir(path string) error {
+	if path == "" || filepath.IsAbs(path) || filepath.Clean(path) != path || strings.Contains(path, volumeIDSep) {
+		return errors.Errorf("invalid volume directory %q", path)
+	}
+	for _, elem := range strings.Split(path, string(filepath.Separator)) {
+		if elem == ".." || strings.HasPrefix(elem, ".") {
+			return errors.Errorf("invalid volume directory %q", path)
+		}
+	}
+	return nil
+}
+
+// legacyVolumeID returns the volume ID a CSI request name was given before
+// IDs named their backend, it is still the default volume directory
+func legacyVolumeID(name string) string {
+	return volumeIDPrefix + uuid.NewSHA1(uuid.NameSpace_OID, []byte(name)).String()
+}
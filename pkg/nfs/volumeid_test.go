@@ -0,0 +1,182 @@
+package nfs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVolumeID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want *volumeLocation
+		err  bool
+	}{
+		{
+			name: "volume id",
+			id:   "v1#192.168.73.184#/nfs/data#csi-nfs-vol-0a2b",
+			want: &volumeLocation{server: "192.168.73.184", share: "/nfs/data", subDir: "csi-nfs-vol-0a2b"},
+		},
+		{
+			name: "host name and directory of a pathPattern",
+			id:   "v1#nfs.example.com#/nfs/data#default/data-web-0",
+			want: &volumeLocation{server: "nfs.example.com", share: "/nfs/data", subDir: "default/data-web-0"},
+		},
+		{
+			name: "legacy volume id",
+			id:   "csi-nfs-vol-6f1d2c3b-8a9e-5c7d-b1e2-3f4a5b6c7d8e",
+		},
+		{
+			name: "empty",
+			id:   "",
+			err:  true,
+		},
+		{
+			name: "legacy volume id with a slash",
+			id:   "csi-nfs-vol-a/b",
+			err:  true,
+		},
+		{
+			name: "hidden legacy volume id",
+			id:   ".csi-nfs",
+			err:  true,
+		},
+		{
+			name: "unsupported version",
+			id:   "v2#192.168.73.184#/nfs/data#vol",
+			err:  true,
+		},
+		{
+			name: "missing directory",
+			id:   "v1#192.168.73.184#/nfs/data",
+			err:  true,
+		},
+		{
+			name: "empty directory",
+			id:   "v1#192.168.73.184#/nfs/data#",
+			err:  true,
+		},
+		{
+			name: "relative share",
+			id:   "v1#192.168.73.184#nfs/data#vol",
+			err:  true,
+		},
+		{
+			name: "invalid server",
+			id:   "v1#nfs_server#/nfs/data#vol",
+			err:  true,
+		},
+		{
+			name: "share containing the separator",
+			id:   "v1#192.168.73.184#/nfs#data#vol",
+			err:  true,
+		},
+		{
+			name: "directory leaving the backend",
+			id:   "v1#192.168.73.184#/nfs/data#../etc",
+			err:  true,
+		},
+		{
+			name: "directory with a parent element",
+			id:   "v1#192.168.73.184#/nfs/data#a/../../etc",
+			err:  true,
+		},
+		{
+			name: "absolute directory",
+			id:   "v1#192.168.73.184#/nfs/data#/etc",
+			err:  true,
+		},
+		{
+			name: "records of the driver",
+			id:   "v1#192.168.73.184#/nfs/data#.csi-nfs/volumes",
+			err:  true,
+		},
+		{
+			name: "hidden directory element",
+			id:   "v1#192.168.73.184#/nfs/data#a/.b",
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseVolumeID(test.id)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got location %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got location %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEncodeVolumeID(t *testing.T) {
+	s := &nfsServer{server: "192.168.73.184", path: "/nfs/data"}
+	for _, subDir := range []string{legacyVolumeID("pvc-1"), "default/data-web-0"} {
+		id := encodeVolumeID(s, subDir)
+		loc, err := parseVolumeID(id)
+		if err != nil {
+			t.Errorf("parse %s: %v", id, err)
+			continue
+		}
+		want := &volumeLocation{server: s.server, share: s.path, subDir: subDir}
+		if !reflect.DeepEqual(loc, want) {
+			t.Errorf("parse %s: got location %+v, want %+v", id, loc, want)
+		}
+	}
+}
+
+func TestValidateSubDir(t *testing.T) {
+	tests := []struct {
+		path string
+		err  bool
+	}{
+		{"vol", false},
+		{"a/b/c", false},
+		{"a..b", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"a/..", true},
+		{"/a", true},
+		{"a/", true},
+		{"a//b", true},
+		{"./a", true},
+		{".hidden", true},
+		{"a/.hidden", true},
+		{"a#b", true},
+	}
+
+	for _, test := range tests {
+		err := validateSubDir(test.path)
+		if test.err && err == nil {
+			t.Errorf("%q: want an error", test.path)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%q: %v", test.path, err)
+		}
+	}
+}
+
+func TestLegacyVolumeID(t *testing.T) {
+	id := legacyVolumeID("pvc-1")
+	if !strings.HasPrefix(id, volumeIDPrefix) {
+		t.Errorf("got %s, want prefix %s", id, volumeIDPrefix)
+	}
+	if again := legacyVolumeID("pvc-1"); again != id {
+		t.Errorf("got %s for the same name again, want %s", again, id)
+	}
+	if other := legacyVolumeID("pvc-2"); other == id {
+		t.Errorf("got %s for another name", other)
+	}
+	if loc, err := parseVolumeID(id); loc != nil || err != nil {
+		t.Errorf("parse %s: got location %+v and error %v, want neither", id, loc, err)
+	}
+}
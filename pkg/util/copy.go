@@ -0,0 +1,139 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const copyBlockSize = 64 * 1024
+
+// CopyTree copies the content of the directory src into the directory dst,
+// keeping ownership, permissions, modification times and symlinks. Blocks of
+// zeros are not written so sparse files stay sparse. It returns the total
+// size of the copied regular files.
+func CopyTree(src, dst string) (int64, error) {
+	var total int64
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			// left behind by an interrupted copy
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(path, target, info.Size()); err != nil {
+				return err
+			}
+			total += info.Size()
+		default:
+			// sockets, fifos and devices are not part of the data
+			return nil
+		}
+
+		return copyAttributes(target, info)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "copy %s to %s", src, dst)
+	}
+
+	// parents are written after their children, restore their times
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(filepath.Join(dst, rel), info.ModTime(), info.ModTime())
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "copy %s to %s", src, dst)
+	}
+
+	return total, nil
+}
+
+// copyFile copies a regular file skipping blocks of zeros
+func copyFile(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := make([]byte, copyBlockSize)
+	zeros := make([]byte, copyBlockSize)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zeros[:n]) {
+				if _, err := out.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a trailing hole is only allocated by setting the size
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// copyAttributes applies the owner, mode and modification time of info
+func copyAttributes(path string, info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(path, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err := os.Chmod(path, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// FsInfo returns the bytes available to unprivileged users and the total
+// capacity of the filesystem holding path
+func FsInfo(path string) (int64, int64, error) {
+	statfs := &unix.Statfs_t{}
+	if err := unix.Statfs(path, statfs); err != nil {
+		return 0, 0, err
+	}
+
+	available := int64(statfs.Bavail) * int64(statfs.Bsize)
+	capacity := int64(statfs.Blocks) * int64(statfs.Bsize)
+	return available, capacity, nil
+}
+
+// FsStat is the space and inodes of a filesystem
+type FsStat struct {
+	// Available is the bytes available to unprivileged users, Free also
+	// counts the bytes reserved for root
+	Available  int64
+	Free       int64
+	Capacity   int64
+	InodesFree int64
+	Inodes     int64
+}
+
+// FsStats returns the space and inodes of the filesystem holding path
+func FsStats(path string) (*FsStat, error) {
+	statfs := &unix.Statfs_t{}
+	if err := unix.Statfs(path, statfs); err != nil {
+		return nil, err
+	}
+
+	return &FsStat{
+		Available:  int64(statfs.Bavail) * int64(statfs.Bsize),
+		Free:       int64(statfs.Bfree) * int64(statfs.Bsize),
+		Capacity:   int64(statfs.Blocks) * int64(statfs.Bsize),
+		InodesFree: int64(statfs.Ffree),
+		Inodes:     int64(statfs.Files),
+	}, nil
+}
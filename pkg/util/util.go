@@ -11,6 +11,8 @@ import (
 var (
 	// serializes operations based on "volume name" as key
 	VolumeNameMutex = keymutex.NewHashed(0)
+	// serializes the creation of volume directories on a backend
+	BackendPathMutex = keymutex.NewHashed(0)
 )
 
 // ValidateDriverName validates the driver name